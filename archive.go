@@ -0,0 +1,233 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// openRoot opens the root to serve files from, which is either
+// a directory, a zip file, or a tar file (optionally gzip compressed).
+func openRoot(name string) (fs.FS, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return dirFS{os.DirFS(name), name}, nil
+	}
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	case strings.HasSuffix(name, ".tar"):
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		fsys, err := newTarFS(f) // reads from f on demand
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return fsys, nil
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return newTarFS(zr)
+	default:
+		return nil, fmt.Errorf("%s: not a directory, zip file, or tar file", name)
+	}
+}
+
+// readLinkFS is a file system that can read the target of symbolic links.
+// It matches the fs.ReadLinkFS interface added in Go 1.25.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// dirFS is the file system of a directory on the host.
+type dirFS struct {
+	fs.FS // from os.DirFS
+	dir   string
+}
+
+func (fsys dirFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys.FS, name)
+}
+
+func (fsys dirFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := os.Readlink(filepath.Join(fsys.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.Unwrap(err)}
+	}
+	return target, nil
+}
+
+// tarFS is a read-only fs.FS of the contents of a tar file.
+// Only regular files and directories are supported;
+// all other entries (e.g., symbolic links) are ignored.
+type tarFS map[string]*tarEntry
+
+// newTarFS reads the headers of the tar file from r.
+// If r is seekable and supports random access (e.g., an *os.File),
+// the contents of regular files are read from r on demand.
+// Otherwise, they are read into memory, up to a total of -archive-limit bytes.
+// It reports an error if an entry is within a non-directory entry.
+func newTarFS(r io.Reader) (tarFS, error) {
+	fsys := tarFS{".": {name: ".", mode: fs.ModeDir | 0555}}
+	ra, _ := r.(io.ReaderAt)
+	rs, _ := r.(io.Seeker)
+	var total int64 // of the contents held in memory
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(h.Name, "/"))
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		e := &tarEntry{name: path.Base(name), modTime: h.ModTime}
+		switch h.Typeflag {
+		case tar.TypeReg:
+			if ra != nil && rs != nil {
+				// The tar reader does not read ahead, so the contents
+				// start at the current offset.
+				offset, err := rs.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return nil, err
+				}
+				e.data = io.NewSectionReader(ra, offset, h.Size)
+			} else {
+				if total += h.Size; total > *archiveMax {
+					return nil, fmt.Errorf("tar file contents exceed -archive-limit of %d bytes", *archiveMax)
+				}
+				b, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, err
+				}
+				e.data = io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+			}
+			e.size = e.data.Size()
+			e.mode = fs.FileMode(h.Mode).Perm()
+		case tar.TypeDir:
+			e.mode = fs.ModeDir | fs.FileMode(h.Mode).Perm()
+		default:
+			continue
+		}
+		fsys[name] = e
+
+		// Implicitly create any parent directories.
+		for dir := path.Dir(name); fsys[dir] == nil; dir = path.Dir(dir) {
+			fsys[dir] = &tarEntry{name: path.Base(dir), mode: fs.ModeDir | 0555}
+		}
+	}
+
+	// Populate the entries of every directory.
+	// An entry within a file (e.g., "a/b" where "a" is a regular file)
+	// could not be listed, so the tar file is rejected as malformed.
+	for name, e := range fsys {
+		if name != "." {
+			parent := fsys[path.Dir(name)]
+			if !parent.IsDir() {
+				return nil, fmt.Errorf("invalid tar file: %s is within non-directory %s", name, path.Dir(name))
+			}
+			parent.entries = append(parent.entries, fs.FileInfoToDirEntry(e))
+		}
+	}
+	for _, e := range fsys {
+		sort.Slice(e.entries, func(i, j int) bool {
+			return e.entries[i].Name() < e.entries[j].Name()
+		})
+	}
+	return fsys, nil
+}
+
+func (fsys tarFS) Open(name string) (fs.File, error) {
+	e := fsys[name]
+	if !fs.ValidPath(name) || e == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.IsDir() {
+		return &tarDir{tarEntry: e}, nil
+	}
+	return &tarFile{tarEntry: e, SectionReader: io.NewSectionReader(e.data, 0, e.size)}, nil
+}
+
+// tarEntry is a file or directory in a tarFS and implements fs.FileInfo.
+type tarEntry struct {
+	name    string
+	mode    fs.FileMode
+	modTime time.Time
+	size    int64
+	data    *io.SectionReader // only for regular files
+	entries []fs.DirEntry     // only for directories
+}
+
+func (e *tarEntry) Name() string               { return e.name }
+func (e *tarEntry) Size() int64                { return e.size }
+func (e *tarEntry) Mode() fs.FileMode          { return e.mode }
+func (e *tarEntry) ModTime() time.Time         { return e.modTime }
+func (e *tarEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e *tarEntry) Sys() interface{}           { return nil }
+func (e *tarEntry) Stat() (fs.FileInfo, error) { return e, nil }
+func (e *tarEntry) Close() error               { return nil }
+
+type tarFile struct {
+	*tarEntry
+	*io.SectionReader
+}
+
+type tarDir struct {
+	*tarEntry
+	offset int
+}
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	d.offset += len(entries)
+	return append([]fs.DirEntry(nil), entries...), nil
+}
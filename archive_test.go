@@ -0,0 +1,156 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// tarEntries returns a tar file with the named entries,
+// where a name with a trailing slash is a directory.
+func tarEntries(t *testing.T, names ...string) *bytes.Buffer {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, name := range names {
+		h := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			h.Mode, h.Typeflag = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &b
+}
+
+func TestTarFS(t *testing.T) {
+	fsys, err := newTarFS(tarEntries(t, "a/", "a/b", "c/d/e", "/f", "./g/../h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "a/b", "c/d/e", "f", "h"); err != nil {
+		t.Error(err)
+	}
+	des, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, de := range des {
+		names = append(names, de.Name())
+	}
+	if want := []string{"a", "c", "f", "h"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("root entries = %q, want %q", names, want)
+	}
+}
+
+func TestTarFSWithinFile(t *testing.T) {
+	for _, names := range [][]string{
+		{"a", "a/b"}, // file before the entry within it
+		{"a/b", "a"}, // file after the entry within it
+		{"a/", "a/b", "a"},
+		{"x/a", "x/a/b/c"},
+	} {
+		if _, err := newTarFS(tarEntries(t, names...)); err == nil || !strings.Contains(err.Error(), "within non-directory") {
+			t.Errorf("newTarFS(%q) error = %v, want an error for an entry within a non-directory", names, err)
+		}
+	}
+}
+
+// tarFiles returns a tar file of regular files with the names and contents
+// in the order given, where names and contents alternate.
+func tarFiles(t *testing.T, nameContents ...string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for i := 0; i < len(nameContents); i += 2 {
+		h := &tar.Header{Name: nameContents[i], Mode: 0644, Size: int64(len(nameContents[i+1])), ModTime: time.Unix(1e9, 0), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(nameContents[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestTarFSOnDemand(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "root.tar")
+	if err := os.WriteFile(name, tarFiles(t, "a.txt", "hello", "sub/b.txt", strings.Repeat("x", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := openRoot(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "a.txt", "sub/b.txt"); err != nil {
+		t.Error(err)
+	}
+	if b, err := fs.ReadFile(fsys, "sub/b.txt"); err != nil || string(b) != strings.Repeat("x", 1000) {
+		t.Errorf("ReadFile(sub/b.txt) = (%d bytes, %v), want 1000 bytes", len(b), err)
+	}
+
+	// Contents are read from the file when opened, rather than at startup,
+	// so rewriting the file in place (with the same layout) is observed.
+	if err := os.WriteFile(name, tarFiles(t, "a.txt", "HELLO", "sub/b.txt", strings.Repeat("y", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(fsys, "a.txt"); err != nil || string(b) != "HELLO" {
+		t.Errorf("ReadFile(a.txt) after rewriting = (%q, %v), want (%q, nil)", b, err, "HELLO")
+	}
+}
+
+func TestTarFSLimit(t *testing.T) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(tarFiles(t, "a.txt", "hello", "b.txt", "world"))
+	zw.Close()
+	name := filepath.Join(t.TempDir(), "root.tar.gz")
+	if err := os.WriteFile(name, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compressed contents are held in memory, up to the limit.
+	setValue(t, archiveMax, 9)
+	if _, err := openRoot(name); err == nil || !strings.Contains(err.Error(), "exceed") {
+		t.Errorf("openRoot with -archive-limit=9: error = %v, want an error for exceeding the limit", err)
+	}
+	setValue(t, archiveMax, 10)
+	fsys, err := openRoot(name)
+	if err != nil {
+		t.Fatalf("openRoot with -archive-limit=10: %v", err)
+	}
+	if err := fstest.TestFS(fsys, "a.txt", "b.txt"); err != nil {
+		t.Error(err)
+	}
+
+	// The limit does not apply to uncompressed tar files.
+	name = filepath.Join(t.TempDir(), "root.tar")
+	if err := os.WriteFile(name, tarFiles(t, "a.txt", "hello", "b.txt", "world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setValue(t, archiveMax, 0)
+	if _, err := openRoot(name); err != nil {
+		t.Errorf("openRoot(root.tar) with -archive-limit=0: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog is an append-only file of JSON records, one per line,
+// for every request that writes to the file system.
+type auditLog struct {
+	name  string
+	fsync bool // whether to sync the file after every record
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openAuditLog opens the named audit log for appending.
+func openAuditLog(name string, fsync bool) (*auditLog, error) {
+	a := &auditLog{name: name, fsync: fsync}
+	if err := a.reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reopen closes and reopens the file (e.g., after it was rotated).
+func (a *auditLog) reopen() error {
+	f, err := os.OpenFile(a.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil {
+		a.f.Close()
+	}
+	a.f = f
+	return nil
+}
+
+// record appends a record of the request, the status of its response,
+// and the number of bytes written to the file system.
+func (a *auditLog) record(r *http.Request, status, n int) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	user, _ := sessionUser(r)
+	b, _ := json.Marshal(struct {
+		Time   time.Time `json:"time"`
+		Client string    `json:"client"`
+		User   string    `json:"user,omitempty"`
+		Method string    `json:"method"`
+		Path   string    `json:"path"`
+		Status int       `json:"status"`
+		Bytes  int       `json:"bytes"`
+	}{time.Now().UTC(), host, user, r.Method, r.URL.Path, status, n})
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.f.Write(append(b, '\n'))
+	if err == nil && a.fsync {
+		err = a.f.Sync()
+	}
+	if err != nil {
+		logger.Error("audit log error", "err", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"logs/": "", "logs/secret.log": "", "a.txt": ""})
+	appendDir, err := os.OpenRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { appendDir.Close() })
+	name := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setValue(t, &appendRx, regexp.MustCompile(`^/logs/`))
+	setValue(t, &appendRoot, appendDir)
+	setValue(t, &audit, a)
+	setValue(t, appendMax, 16)
+	setValue(t, deny, "^/logs/secret")
+	setValue(t, &authUsers, map[string]string{"alice": "secret"})
+	setValue(t, &sessionSecret, []byte("session secret"))
+	h := newTestHandler(t, root)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	session := &http.Cookie{Name: sessionCookie, Value: base64.RawURLEncoding.EncodeToString([]byte("alice")) + "." + strconv.FormatInt(exp, 10) + "." + sessionSignature("alice", exp)}
+	post := func(target, body string) int {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		r.AddCookie(session)
+		resp, _ := serveRequest(h, r)
+		return resp.StatusCode
+	}
+
+	// Only successful appends are recorded, each exactly once.
+	for _, tt := range []struct {
+		target string
+		body   string
+		status int
+	}{
+		{"/logs/a.log", "hello\n", http.StatusNoContent},
+		{"/a.txt", "denied\n", http.StatusMethodNotAllowed},
+		{"/logs/secret.log", "denied\n", http.StatusForbidden},
+		{"/logs/", "directory\n", http.StatusMethodNotAllowed},
+		{"/logs/a.log", "far too long for the limit\n", http.StatusRequestEntityTooLarge},
+		{"/logs/missing/a.log", "missing\n", http.StatusNotFound},
+		{"/logs/b.log", "", http.StatusNoContent},
+		{"/logs/a.log", "world\n", http.StatusNoContent},
+	} {
+		if status := post(tt.target, tt.body); status != tt.status {
+			t.Errorf("POST %s: status = %d, want %d", tt.target, status, tt.status)
+		}
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type record struct {
+		User   string `json:"user"`
+		Method string `json:"method"`
+		Path   string `json:"path"`
+		Status int    `json:"status"`
+		Bytes  int    `json:"bytes"`
+	}
+	var got []record
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		var rec record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("invalid audit record %q: %v", line, err)
+		}
+		got = append(got, rec)
+	}
+	want := []record{
+		{"alice", http.MethodPost, "/logs/a.log", http.StatusNoContent, len("hello\n")},
+		{"alice", http.MethodPost, "/logs/b.log", http.StatusNoContent, 0},
+		{"alice", http.MethodPost, "/logs/a.log", http.StatusNoContent, len("world\n")},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("audit log has %d records, want %d:\n%s", len(got), len(want), b)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("audit record %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
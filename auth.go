@@ -0,0 +1,262 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	loginPath     = "/.login"
+	logoutPath    = "/.logout"
+	sessionCookie = "file-server-session"
+)
+
+// errUnauthorized reports that the request requires logging in.
+var errUnauthorized = errors.New("login required")
+
+var (
+	authUsers     map[string]string // username to password; nil if logins are disabled
+	sessionSecret []byte
+	totpKey       []byte // nil if two-factor authentication is disabled
+
+	totpMu   sync.Mutex
+	totpUsed = make(map[int64]bool) // TOTP time steps whose code was used
+)
+
+// readAuthFile reads a file of "username:password" lines.
+// Empty lines and lines starting with '#' are ignored.
+func readAuthFile(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("%s:%d: line must be of the form 'username:password'", name, n)
+		}
+		users[user] = password
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no users", name)
+	}
+	return users, nil
+}
+
+// checkPassword reports whether the password is correct for the user
+// in constant time with respect to the contents of the password.
+func checkPassword(user, password string) bool {
+	want, ok := authUsers[user]
+	got, want2 := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(got[:], want2[:]) == 1 && ok
+}
+
+// parseTOTPSecret parses a base32 encoded TOTP secret,
+// ignoring spaces, case, and padding.
+func parseTOTPSecret(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.ToUpper(strings.ReplaceAll(s, " ", "")), "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	return key, nil
+}
+
+// totpCode computes the 6-digit TOTP code (RFC 6238) for a time step,
+// which is the HOTP code (RFC 4226) using HMAC-SHA1 with the step as the counter.
+func totpCode(key []byte, step int64) string {
+	m := hmac.New(sha1.New, key)
+	binary.Write(m, binary.BigEndian, step)
+	sum := m.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+// checkTOTP reports whether code is the TOTP code for the current time step,
+// or the one before or after it to allow for clock skew.
+// Since all users share the same secret, a code is only accepted once
+// across all users, so a code cannot be replayed by anyone who observed it
+// (for the same or any other user), even while it is still valid.
+func checkTOTP(code string, now time.Time) bool {
+	const period = 30 // seconds
+	totpMu.Lock()
+	defer totpMu.Unlock()
+	step := now.Unix() / period
+	for s := range totpUsed {
+		if s < step-1 {
+			delete(totpUsed, s) // codes for the step are no longer accepted
+		}
+	}
+	for _, s := range []int64{step - 1, step, step + 1} {
+		if subtle.ConstantTimeCompare([]byte(code), []byte(totpCode(totpKey, s))) == 1 {
+			if totpUsed[s] {
+				return false // already used
+			}
+			totpUsed[s] = true
+			return true
+		}
+	}
+	return false
+}
+
+// sessionSignature computes the signature of a session for the user
+// that expires at the given Unix time, using the session secret.
+func sessionSignature(user string, exp int64) string {
+	m := hmac.New(sha256.New, sessionSecret)
+	m.Write([]byte("session\n" + user + "\n" + strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// sessionUser reports the user of a valid, unexpired session cookie.
+func sessionUser(r *http.Request) (string, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	user := string(b)
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !hmac.Equal([]byte(parts[2]), []byte(sessionSignature(user, exp))) {
+		return "", false
+	}
+	if _, ok := authUsers[user]; !ok || time.Now().Unix() > exp {
+		return "", false
+	}
+	return user, true
+}
+
+// setSessionCookie sets (or clears if user is empty) the session cookie.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, user string) {
+	c := &http.Cookie{
+		Name:     sessionCookie,
+		Path:     externalPrefix(r) + "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if user == "" {
+		c.MaxAge = -1
+	} else {
+		exp := time.Now().Add(*sessionTTL).Unix()
+		c.Value = base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(exp, 10) + "." + sessionSignature(user, exp)
+		c.MaxAge = int(sessionTTL.Seconds())
+	}
+	http.SetCookie(w, c)
+}
+
+// isHTTPS reports whether the client connected using HTTPS,
+// either directly or through a trusted proxy.
+func isHTTPS(r *http.Request) bool {
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" && isTrustedProxy(r) {
+		return p == "https"
+	}
+	return r.TLS != nil
+}
+
+// localRedirect reports whether next is a path on this server,
+// such that redirecting to it is not an open redirect.
+// Since browsers remove tabs and newlines from URLs and treat backslashes
+// as slashes, paths with control characters or backslashes are rejected
+// (e.g., "/\t/evil.example" is treated as "//evil.example").
+func localRedirect(next string) bool {
+	if strings.IndexFunc(next, isControl) >= 0 || strings.Contains(next, `\`) || strings.HasPrefix(next, "//") {
+		return false
+	}
+	u, err := url.Parse(next)
+	return err == nil && u.Scheme == "" && u.Host == "" && u.User == nil &&
+		strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//")
+}
+
+// serveLogin serves the login form and handles submissions of it.
+// A successful login sets the session cookie and redirects to the
+// page given by the "next" query parameter.
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	if !localRedirect(next) {
+		next = externalPrefix(r) + "/"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, http.StatusOK, "", "login.html", loginPage{TOTP: totpKey != nil})
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+	user := r.PostFormValue("username")
+	ok := checkPassword(user, r.PostFormValue("password"))
+	if ok && totpKey != nil {
+		ok = checkTOTP(r.PostFormValue("code"), time.Now())
+	}
+	if !ok {
+		logger.Info("incorrect login", "user", user, "remote", r.RemoteAddr)
+		renderTemplate(w, r, http.StatusForbidden, "", "login.html", loginPage{Username: user, Incorrect: true, TOTP: totpKey != nil})
+		return
+	}
+	setSessionCookie(w, r, user)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// serveLogout clears the session cookie and redirects to the login form.
+func serveLogout(w http.ResponseWriter, r *http.Request) {
+	setSessionCookie(w, r, "")
+	http.Redirect(w, r, externalPrefix(r)+loginPath, http.StatusSeeOther)
+}
+
+// requireLogin responds to a request without a valid session.
+// Browsers are redirected to the login form, while other clients
+// are reported StatusUnauthorized.
+func requireLogin(w http.ResponseWriter, r *http.Request) {
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && negotiateType(r, "text/html", "application/json") == "text/html" {
+		next := (&url.URL{Path: externalPrefix(r) + r.URL.Path, RawQuery: r.URL.RawQuery}).String()
+		http.Redirect(w, r, externalPrefix(r)+loginPath+"?"+url.Values{"next": {next}}.Encode(), http.StatusSeeOther)
+		return
+	}
+	httpError(w, r, errUnauthorized)
+}
+
+// newSessionSecret returns a random secret for signing sessions.
+func newSessionSecret() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}
@@ -0,0 +1,218 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalRedirect(t *testing.T) {
+	for next, want := range map[string]bool{
+		"/":                        true,
+		"/sub/a.txt":               true,
+		"/sub/?sort=size#top":      true,
+		"/a%20b":                   true,
+		"":                         false,
+		"sub/":                     false,
+		"//evil.example":           false,
+		"///evil.example":          false,
+		`/\evil.example`:           false,
+		`\/evil.example`:           false,
+		"/\t/evil.example":         false,
+		"/\n/evil.example":         false,
+		"/\r\n/evil.example":       false,
+		"\t//evil.example":         false,
+		"/%2F/evil.example":        false,
+		"https://evil.example/":    false,
+		"javascript:alert(1)":      false,
+		"/foo\x00":                 false,
+		"/foo\x7f":                 false,
+		"http:/evil.example":       false,
+		"/user@evil.example":       true, // a path, not a host
+		"//user@evil.example/path": false,
+	} {
+		if got := localRedirect(next); got != want {
+			t.Errorf("localRedirect(%q) = %v, want %v", next, got, want)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello"})
+	setValue(t, &authUsers, map[string]string{"alice": "secret", "bob": "hunter2"})
+	setValue(t, &sessionSecret, []byte("session secret"))
+	h := newTestHandler(t, root)
+
+	login := func(next string) *http.Response {
+		form := url.Values{"username": {"alice"}, "password": {"secret"}}
+		r := httptest.NewRequest(http.MethodPost, loginPath+"?"+url.Values{"next": {next}}.Encode(), strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, _ := serveRequest(h, r)
+		return resp
+	}
+
+	// Logging in redirects only to local paths.
+	for next, want := range map[string]string{
+		"/a.txt":                "/a.txt",
+		"/\t/evil.example":      "/",
+		"//evil.example":        "/",
+		"https://evil.example/": "/",
+	} {
+		resp := login(next)
+		if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != want {
+			t.Errorf("login with next %q = (%d, %q), want (303, %q)", next, resp.StatusCode, resp.Header.Get("Location"), want)
+		}
+	}
+
+	// A session cookie is only valid if it is correctly signed,
+	// for a known user, and unexpired.
+	var session *http.Cookie
+	for _, c := range login("/").Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("login did not set the session cookie")
+	}
+	cookie := func(user string, exp int64, sig string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(exp, 10) + "." + sig
+	}
+	future, past := time.Now().Add(time.Hour).Unix(), time.Now().Add(-time.Second).Unix()
+	for _, tt := range []struct {
+		name   string
+		value  string
+		status int
+	}{
+		{"valid", session.Value, http.StatusOK},
+		{"resigned", cookie("alice", future, sessionSignature("alice", future)), http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"bad signature", cookie("alice", future, "AAAA"), http.StatusUnauthorized},
+		{"wrong user", cookie("bob", future, sessionSignature("alice", future)), http.StatusUnauthorized},
+		{"wrong expiry", cookie("alice", future+1, sessionSignature("alice", future)), http.StatusUnauthorized},
+		{"expired", cookie("alice", past, sessionSignature("alice", past)), http.StatusUnauthorized},
+		{"unknown user", cookie("mallory", future, sessionSignature("mallory", future)), http.StatusUnauthorized},
+		{"malformed", "alice." + strconv.FormatInt(future, 10), http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+		r.Header.Set("Accept", "application/json")
+		if tt.value != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.value})
+		}
+		if resp, _ := serveRequest(h, r); resp.StatusCode != tt.status {
+			t.Errorf("%s session: status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	setValue(t, &totpKey, []byte("12345678901234567890"))
+	setValue(t, &totpUsed, make(map[int64]bool))
+	now := time.Unix(59, 0) // time step 1
+	if got := totpCode(totpKey, now.Unix()/30); got != "287082" {
+		t.Fatalf("totpCode = %s, want 287082 (RFC 6238 test vector)", got)
+	}
+
+	// Codes for adjacent time steps are accepted to allow for clock skew.
+	for step := int64(-2); step <= 2; step++ {
+		setValue(t, &totpUsed, make(map[int64]bool))
+		now := time.Unix(1000*30, 0)
+		code := totpCode(totpKey, 1000+step)
+		want := -1 <= step && step <= 1
+		if got := checkTOTP(code, now); got != want {
+			t.Errorf("code for step %+d: accepted = %v, want %v", step, got, want)
+		}
+	}
+	if checkTOTP("", now) || checkTOTP("000000", now) {
+		t.Error("invalid code accepted")
+	}
+
+	// A code is only accepted once, even for another user.
+	setValue(t, &totpUsed, make(map[int64]bool))
+	code := totpCode(totpKey, 1000)
+	if !checkTOTP(code, time.Unix(1000*30, 0)) {
+		t.Fatal("code not accepted")
+	}
+	if checkTOTP(code, time.Unix(1000*30+29, 0)) {
+		t.Error("code replayed within the same time step")
+	}
+	if checkTOTP(code, time.Unix(1001*30, 0)) {
+		t.Error("code replayed in the next time step")
+	}
+	if !checkTOTP(totpCode(totpKey, 1001), time.Unix(1001*30, 0)) {
+		t.Error("code for the next time step not accepted")
+	}
+	if n := len(totpUsed); n > 3 {
+		t.Errorf("%d used time steps recorded, want at most 3", n)
+	}
+}
+
+func TestLoginTOTPReplay(t *testing.T) {
+	root := t.TempDir()
+	setValue(t, &authUsers, map[string]string{"alice": "secret", "bob": "hunter2"})
+	setValue(t, &sessionSecret, []byte("session secret"))
+	setValue(t, &totpKey, []byte("12345678901234567890"))
+	setValue(t, &totpUsed, make(map[int64]bool))
+	h := newTestHandler(t, root)
+
+	login := func(user, password, code string) int {
+		form := url.Values{"username": {user}, "password": {password}, "code": {code}}
+		r := httptest.NewRequest(http.MethodPost, loginPath, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, _ := serveRequest(h, r)
+		return resp.StatusCode
+	}
+	code := totpCode(totpKey, time.Now().Unix()/30)
+	if status := login("alice", "secret", code); status != http.StatusSeeOther {
+		t.Fatalf("login as alice: status = %d, want 303", status)
+	}
+	if status := login("alice", "secret", code); status != http.StatusForbidden {
+		t.Errorf("replayed login as alice: status = %d, want 403", status)
+	}
+	if status := login("bob", "hunter2", code); status != http.StatusForbidden {
+		t.Errorf("replayed login as bob: status = %d, want 403", status)
+	}
+}
+
+func TestLoginSingleFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"page.html": "<p>maintenance</p>"})
+	setValue(t, singleFile, filepath.Join(root, "page.html"))
+	setValue(t, &authUsers, map[string]string{"alice": "secret"})
+	setValue(t, &sessionSecret, []byte("session secret"))
+	h := newTestHandler(t, root)
+
+	// Without a session, every path redirects to the login form.
+	for _, target := range []string{"/", "/anything", "/x/y"} {
+		resp, body := get(h, target)
+		loc, _ := url.Parse(resp.Header.Get("Location"))
+		if resp.StatusCode != http.StatusSeeOther || loc == nil || loc.Path != loginPath || loc.Query().Get("next") != target {
+			t.Errorf("GET %s = (%d, %s), want (303, %s?next=%s)", target, resp.StatusCode, resp.Header.Get("Location"), loginPath, target)
+		}
+		if strings.Contains(body, "maintenance") {
+			t.Errorf("GET %s: served the file without a login", target)
+		}
+	}
+
+	// The login form itself is still served, after which the file is.
+	if resp, _ := get(h, loginPath); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET %s: status = %d, want 200", loginPath, resp.StatusCode)
+	}
+	future := time.Now().Add(time.Hour).Unix()
+	r := httptest.NewRequest(http.MethodGet, "/anything", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: base64.RawURLEncoding.EncodeToString([]byte("alice")) + "." + strconv.FormatInt(future, 10) + "." + sessionSignature("alice", future)})
+	if resp, body := serveRequest(h, r); resp.StatusCode != http.StatusOK || body != "<p>maintenance</p>" {
+		t.Errorf("GET /anything with a session = (%d, %q), want (200, the file)", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// config is an immutable snapshot of the settings that may be reloaded.
+// Each request loads the current config once and uses it throughout,
+// so that a concurrent reload cannot change the settings mid-request.
+type config struct {
+	hideRx   *regexp.Regexp
+	denyRx   *regexp.Regexp
+	indexRx  *regexp.Regexp
+	readmeRx *regexp.Regexp
+
+	allowDirectRx *regexp.Regexp
+
+	redirects []redirectRule // read from the redirects file
+}
+
+// currentConfig is the config used by new requests.
+var currentConfig atomic.Pointer[config]
+
+// patternFlags are the flags of regular expressions that take effect
+// when the config file is reloaded, and the config fields they compile to.
+var patternFlags = []struct {
+	name  string
+	field func(*config) **regexp.Regexp
+}{
+	{"hide", func(c *config) **regexp.Regexp { return &c.hideRx }},
+	{"deny", func(c *config) **regexp.Regexp { return &c.denyRx }},
+	{"index", func(c *config) **regexp.Regexp { return &c.indexRx }},
+	{"readme", func(c *config) **regexp.Regexp { return &c.readmeRx }},
+	{"allow-direct", func(c *config) **regexp.Regexp { return &c.allowDirectRx }},
+}
+
+// explicitFlags are the flags set on the command line,
+// which take precedence over the config file.
+var explicitFlags = make(map[string]bool)
+
+// readConfig reads a config file of flag settings.
+// Each line is of the form "name=value" (or just "name" for a boolean flag
+// that is true), where the name may have leading dashes.
+// Empty lines and lines starting with '#' are ignored.
+func readConfig(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	settings := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(strings.TrimLeft(line, "-"), "=")
+		if !ok {
+			v = "true"
+		}
+		if flag.Lookup(k) == nil || k == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q", name, n, k)
+		}
+		settings[k] = v
+	}
+	return settings, s.Err()
+}
+
+// loadConfig sets the flags in the config file,
+// except for those already set on the command line.
+func loadConfig(name string) error {
+	flag.Visit(func(f *flag.Flag) { explicitFlags[f.Name] = true })
+	settings, err := readConfig(name)
+	if err != nil {
+		return err
+	}
+	for k, v := range settings {
+		if !explicitFlags[k] {
+			if err := flag.Set(k, v); err != nil {
+				return fmt.Errorf("%s: invalid value %q for flag %s: %v", name, v, k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// compilePattern compiles a regular expression,
+// where an empty pattern compiles to nil (matching nothing).
+func compilePattern(s string) (*regexp.Regexp, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return regexp.Compile(s)
+}
+
+// reloadConfig rereads the config file (if any) and the redirects file
+// in the root directory, and replaces the current config.
+// Flags set on the command line still take precedence,
+// and flags absent from the config file revert to their default.
+// Other flags in the config file do not take effect until a restart.
+// If any pattern or redirect rule is invalid, then the current config is kept.
+func reloadConfig(name string, dir fs.FS) error {
+	c := *currentConfig.Load()
+	if name != "" {
+		settings, err := readConfig(name)
+		if err != nil {
+			return err
+		}
+		for _, pf := range patternFlags {
+			f := flag.Lookup(pf.name)
+			v, ok := settings[pf.name]
+			switch {
+			case explicitFlags[pf.name]:
+				v = f.Value.String()
+			case !ok:
+				v = f.DefValue
+			}
+			if *pf.field(&c), err = compilePattern(v); err != nil {
+				return fmt.Errorf("invalid %s pattern: %v", pf.name, err)
+			}
+		}
+	}
+	var err error
+	if c.redirects, err = readRedirects(dir); err != nil {
+		return err
+	}
+	currentConfig.Store(&c)
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt":         "hello",
+		".hidden":       "hidden",
+		"secret.txt":    "secret",
+		"sub/home.html": "<p>home</p>",
+	})
+	configFile := filepath.Join(t.TempDir(), "config")
+	writeConfig := func(s string) {
+		if err := os.WriteFile(configFile, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := openRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFlagsConfig(t, dir)
+	h := newHandler(dir)
+
+	// check checks the behavior of the hide, deny, and index patterns.
+	check := func(hidden, denied, indexed bool) {
+		t.Helper()
+		_, entries, _ := listing(t, h, "/")
+		if _, listed := entries["a.txt"]; listed == hidden {
+			t.Errorf("a.txt listed = %v, want %v", listed, !hidden)
+		}
+		if _, listed := entries[".hidden"]; listed != hidden {
+			t.Errorf(".hidden listed = %v, want %v", listed, hidden)
+		}
+		if resp, _ := get(h, "/secret.txt"); (resp.StatusCode == http.StatusForbidden) != denied {
+			t.Errorf("GET /secret.txt: status = %d, want denied %v", resp.StatusCode, denied)
+		}
+		if _, body := get(h, "/sub/"); strings.Contains(body, "<p>home</p>") != indexed {
+			t.Errorf("GET /sub/ served the index = %v, want %v", !indexed, indexed)
+		}
+	}
+	check(false, false, false)
+
+	// Reloading the config file changes the behavior of later requests.
+	writeConfig("hide=/a[.]txt$\n-deny=^/secret[.]txt$\n--index=/home[.]html$\n")
+	if err := reloadConfig(configFile, dir); err != nil {
+		t.Fatal(err)
+	}
+	check(true, true, true)
+
+	// An invalid config file keeps the current config.
+	writeConfig("deny=(\n")
+	if err := reloadConfig(configFile, dir); err == nil {
+		t.Error("reloadConfig with an invalid pattern succeeded")
+	}
+	check(true, true, true)
+
+	// Patterns absent from the config file revert to their defaults.
+	writeConfig("# empty\n")
+	if err := reloadConfig(configFile, dir); err != nil {
+		t.Fatal(err)
+	}
+	check(false, false, false)
+
+	// Patterns set on the command line take precedence.
+	setValue(t, &explicitFlags, map[string]bool{"deny": true})
+	setValue(t, deny, "^/secret[.]txt$")
+	writeConfig("deny=^/a[.]txt$\n")
+	if err := reloadConfig(configFile, dir); err != nil {
+		t.Fatal(err)
+	}
+	check(false, true, false)
+}
+
+func TestReloadConfigConcurrent(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello", "secret.txt": "secret", "sub/b.txt": "world"})
+	configs := make([]string, 2)
+	for i, s := range []string{"deny=^/secret[.]txt$\n", "hide=/a[.]txt$\nindex=/b[.]txt$\n"} {
+		configs[i] = filepath.Join(t.TempDir(), "config")
+		if err := os.WriteFile(configs[i], []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := openRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFlagsConfig(t, dir)
+	h := newHandler(dir)
+
+	// Serve requests while the config is repeatedly reloaded.
+	// Run with -race to detect unsynchronized access to the config.
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := reloadConfig(configs[i%len(configs)], dir); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				for _, target := range []string{"/", "/a.txt", "/secret.txt", "/sub/", "/?du=true"} {
+					if resp, _ := get(h, target); resp.StatusCode >= 500 {
+						t.Errorf("GET %s: status = %d", target, resp.StatusCode)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	if err := <-errc; err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+}
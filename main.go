@@ -6,36 +6,126 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"html"
+	"html/template"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
+//go:embed favicon.ico
+var defaultFavicon []byte
+
 var (
-	addr     = flag.String("addr", ":8080", "The network address to listen on.")
-	hide     = flag.String("hide", "/[.][^/]+/?$", "Regular expression of file paths to hide.\nPaths matching this pattern are excluded from directory listings,\nbut direct requests for this path are still resolved.")
-	deny     = flag.String("deny", "", "Regular expression of file paths to deny.\nPaths matching this pattern are excluded from directory listings\nand direct requests for this path report StatusForbidden.")
-	index    = flag.String("index", "", "Regular expression of file paths to treat as index.html pages.\n(e.g., '/index[.]html$'; default none)")
-	root     = flag.String("root", ".", "Directory to serve files from.")
-	sendfile = flag.Bool("sendfile", true, "Allow the use of the sendfile syscall.")
-	verbose  = flag.Bool("verbose", false, "Log every HTTP request.")
-
-	hideRx  *regexp.Regexp
-	denyRx  *regexp.Regexp
-	indexRx *regexp.Regexp
+	configFile        = flag.String("config", "", "Path to a file of flag settings, one 'name=value' per line.\nFlags set on the command line take precedence. Upon SIGHUP, the file is\nreread and the hide, deny, allow-direct, index, and readme patterns are replaced.\n(default none)")
+	addr              = flag.String("addr", ":8080", "The network address to listen on.")
+	hide              = flag.String("hide", "/[.][^/]+/?$", "Regular expression of file paths to hide.\nPaths matching this pattern are excluded from directory listings,\nbut direct requests for this path are still resolved.")
+	denyNotFound      = flag.Bool("deny-as-notfound", false, "Report StatusNotFound instead of StatusForbidden for paths matching the deny pattern,\nsuch that they are indistinguishable from paths that do not exist.")
+	hideStrict        = flag.Bool("hide-strict", false, "Report StatusNotFound for direct requests for paths matching the hide pattern\n(or within a directory matching it), unless they match the allow-direct pattern.")
+	allowDirect       = flag.String("allow-direct", "", "Regular expression of hidden file paths that may still be requested directly\nwhen hide-strict is set. (default none)")
+	deny              = flag.String("deny", "", "Regular expression of file paths to deny.\nPaths matching this pattern are excluded from directory listings\nand direct requests for this path report StatusForbidden.")
+	index             = flag.String("index", "", "Regular expression of file paths to treat as index.html pages.\n(e.g., '/index[.]html$'; default none)")
+	indexNames        = flag.String("index-names", "", "Comma-separated list of file names to treat as index.html pages,\nin order of decreasing priority. If a directory has several of them,\nthe first one in the list is served. This takes precedence over -index.\n(e.g., 'index.html,index.htm'; default none)")
+	appendPat         = flag.String("append", "", "Regular expression of file paths that accept POST requests,\nwhich append the request body to the file (creating it if necessary).\nPaths matching the deny pattern never accept appends.\n(e.g., '^/logs/[^/]+[.]log$'; default none)")
+	appendMax         = flag.Int64("append-limit", 1<<20, "Maximum size in bytes of the request body for a POST append.")
+	statMax           = flag.Int("stat-limit", 1000, "Maximum number of paths in a single POST request to /.stat.")
+	auditLogPath      = flag.String("audit-log", "", "Path to a file that a JSON record is appended to for every request\nthat writes to the file system (i.e., successful POST appends).\nThe file is reopened upon SIGHUP so that it may be rotated. (default none)")
+	auditFsync        = flag.Bool("audit-fsync", false, "Sync the audit log to stable storage after every record.")
+	readme            = flag.String("readme", "", "Regular expression of file paths to render as plain text below directory listings.\nMatching files are rendered even if they are hidden from the listing.\n(e.g., '/README([.](md|txt))?$'; default none)")
+	prefix            = flag.String("prefix", "", "URL path prefix that the server is mounted under.\nThe prefix is stripped from every request path.\n(e.g., '/files' when behind a reverse proxy; default none)")
+	root              = flag.String("root", ".", "Directory to serve files from.\nThis may also be a zip or tar file (optionally gzip compressed),\nin which case its contents are served read-only.")
+	archiveMax        = flag.Int64("archive-limit", 1<<30, "Maximum total size in bytes of the files in each gzip-compressed tar file\nbeing served, which is decompressed into memory at startup.\nUncompressed tar files and zip files are read on demand instead.")
+	singleFile        = flag.String("single-file", "", "Path to a file to serve for every request, regardless of the request path\nwithin the prefix. The root directory and directory listings are not used,\nbut logins are still required if enabled. (default none)")
+	favicon           = flag.String("favicon", "", "Path to an icon to serve for '/favicon.ico' if the root directory does not have one.\n(default a built-in icon)")
+	robots            = flag.String("robots", "", "Content to serve for '/robots.txt' if the root directory does not have one.\nEither 'allow' to allow all crawlers, 'deny' to deny all crawlers,\nor the path to a custom file. (default none)")
+	overlay           = flag.String("overlay", "", "List of directories (separated by the OS-specific path list separator)\nto layer beneath the root directory, in order of decreasing precedence.\nFiles in upper layers shadow files of the same name in lower layers,\nwhile directory listings are merged. A file named '.wh.NAME' hides\nthe file NAME in lower layers. (default none)")
+	links             = flag.Bool("show-links", false, "Show the target of symbolic links in directory listings.\nTargets that lexically resolve outside the root directory are marked.\nLinks are not shown when serving a zip or tar file.")
+	showOwner         = flag.Bool("show-owner", false, "Show the user and group that own each entry in directory listings,\nif the operating system reports them.")
+	showLinkCount     = flag.Bool("show-link-count", false, "Show the number of hard links to each entry in directory listings,\nif the operating system reports them.")
+	sidecars          = flag.Bool("sidecars", false, "Merge the description and tags of metadata sidecar files\n(e.g., 'foo.jpg.meta.json' for 'foo.jpg') into directory listings.\nSidecar files are excluded from directory listings.")
+	inlineTypes       = flag.String("inline-types", "", "Comma-separated list of file extensions (e.g., '.pdf,.txt')\nthat browsers are told to display inline. (default none)")
+	attachmentTypes   = flag.String("attachment-types", "", "Comma-separated list of file extensions (e.g., '.csv,.zip')\nthat browsers are told to download as an attachment. (default none)")
+	sniffContent      = flag.Bool("sniff-content", false, "Determine the Content-Type of files by sniffing their contents\ninstead of using the file extension.")
+	sendfile          = flag.Bool("sendfile", true, "Allow the use of the sendfile syscall.")
+	serverTiming      = flag.Bool("server-timing", false, "Report the time spent resolving the path, reading the directory,\nand serving the response in the Server-Timing header of every response.")
+	copyBufSize       = flag.Int("copy-buffer-size", 32<<10, "Size in bytes of the buffer used to copy file contents\nwhen the sendfile syscall cannot be used.")
+	maxRate           = flag.Int64("max-rate", 0, "Maximum rate in bytes per second to send file contents over each connection.\nThe sendfile syscall is not used when rate limited. (default unlimited)")
+	maxTotalRate      = flag.Int64("max-total-rate", 0, "Maximum rate in bytes per second to send file contents over all connections combined.\nThe sendfile syscall is not used when rate limited. (default unlimited)")
+	trusted           = flag.String("trusted-proxy", "", "Comma-separated list of IP addresses or CIDR ranges of trusted proxies.\nOnly requests from these addresses may use the X-Forwarded-Prefix\nand X-Forwarded-Host headers to describe the external URL.")
+	defaultSort       = flag.String("default-sort", "name", "Order of entries in directory listings.\nEither 'name', 'natural', 'size', or 'date', optionally with a '-desc' suffix\nfor descending order (e.g., 'date-desc' to list the newest entries first).\nThe 'natural' order is by name, but compares embedded numbers numerically.")
+	imageDimsMax      = flag.Int("image-dimensions", 100, "Maximum number of GIF, JPEG, and PNG images per directory listing\nto report the width and height of, which is read from the image header.")
+	mediaDurMax       = flag.Int("media-durations", 0, "Maximum number of audio and video files per directory listing\nto report the duration of, which is read from the container headers.\nSupported formats are WAV, FLAC, and MP4 (including M4A, M4V, and MOV).\n(default none)")
+	listHidden        = flag.Bool("list-hidden", false, "Allow directory listings to include paths matching the hide pattern\nwhen requested with '?hidden=true'. Denied paths are never listed.")
+	noIndex           = flag.Bool("no-index", false, "Disable directory listings, such that requests for directories\nreport StatusForbidden unless the directory has an index file.\nFiles may still be requested directly.")
+	maxListEntries    = flag.Int("max-list-entries", 10000, "Maximum number of entries in a directory listing, beyond which\nthe listing is truncated and links to the next page of entries.\nA zero value is unlimited.")
+	parentEntry       = flag.Bool("parent-entry", false, "Include a '../' entry for the parent directory at the top of directory listings,\nexcept for the root directory.")
+	sortNatural       = flag.Bool("sort-natural", false, "Compare embedded numbers in names numerically for all sort orders\n(e.g., 'file2' sorts before 'file10').")
+	dirsFirst         = flag.Bool("dirs-first", false, "List directories before files in directory listings, regardless of the sort order.")
+	dirsLast          = flag.Bool("dirs-last", false, "List directories after files in directory listings, regardless of the sort order.")
+	authFile          = flag.String("auth-file", "", "Path to a file of 'username:password' lines.\nIf specified, every request requires logging in through a form at '/.login',\nexcept for share links. (default logins are disabled)")
+	sessionKey        = flag.String("session-secret", "", "Secret key used to sign login session cookies.\n(default a random key, such that sessions do not survive a restart)")
+	sessionTTL        = flag.Duration("session-ttl", 24*time.Hour, "Duration until a login session expires.")
+	totpSecret        = flag.String("totp-secret", "", "Base32 encoded secret for two-factor authentication with TOTP codes\n(e.g., from an authenticator app), which are required to log in.\n(default two-factor authentication is disabled)")
+	shareSecret       = flag.String("share-secret", "", "Secret key used to sign share links, which serve a single file until they expire.\nFiles served through share links are exempt from the deny pattern.\n(default share links are disabled)")
+	mintShare         = flag.String("mint-share", "", "Print a share link for the given file path (e.g., '/docs/report.pdf') and exit.\nThe link is signed using -share-secret and expires after -share-ttl.")
+	shareTTL          = flag.Duration("share-ttl", 24*time.Hour, "Duration until a share link printed by -mint-share expires.")
+	sharePassword     = flag.String("share-password", "", "Password required to use a share link printed by -mint-share.\n(default no password)")
+	title             = flag.String("title", "", "Title of every HTML page, where '{dir}' is replaced by the name of the requested path.\nA directory with a '.title' file uses the first line of that file as its name instead.\n(e.g., 'My Files - {dir}'; default just the name)")
+	templateDir       = flag.String("template-dir", "", "Directory of templates (in html/template syntax) that override\nthe built-in 'main.html', 'body.html', 'recent.html', 'share.html',\n'login.html', and 'error.html' pages.\nTemplates absent from the directory use the built-in version. (default none)")
+	sizeUnits         = flag.String("size-units", "iec", "Prefixes used to format file sizes.\nEither 'iec' for powers of 1024 (e.g., 'MiB') or 'si' for powers of 1000 (e.g., 'MB').")
+	fsTimeout         = flag.Duration("fs-timeout", 0, "Maximum duration for each file system operation (e.g., open, stat, or read).\nOperations beyond the limit report StatusGatewayTimeout, which guards\nagainst hung network file systems. (default none)")
+	walkTimeout       = flag.Duration("walk-timeout", 10*time.Second, "Maximum duration to spend walking a directory tree\n(e.g., for the '?recent=N', '?dupes', and '?du' views of a directory).")
+	dupesMinSize      = flag.Int64("dupes-min-size", 1, "Minimum size in bytes of files reported by the '?dupes' view of a directory.")
+	duCacheTTL        = flag.Duration("du-cache-ttl", time.Minute, "Duration to cache the results of the '?du' view of a directory.\nA result is recomputed sooner if the directory itself is modified, but not\nif only files in its subdirectories change, which are reflected only once\nthe result expires or is requested with '&refresh=true'.\nA zero value disables the cache.")
+	viewMax           = flag.Int64("view-limit", 1<<20, "Maximum number of bytes of a file shown by the '?view=hex' and '?view=text' viewers.")
+	logLevel          = flag.String("log-level", "info", "Logging verbosity. One of:\n'error' to only log failures,\n'info' to also log server startup, or\n'debug' to also log every HTTP request and file system operation.")
+	readTimeout       = flag.Duration("read-timeout", 0, "Maximum duration for reading an entire request, including the body.\n(default none)")
+	readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "Maximum duration for reading the request headers.")
+	writeTimeout      = flag.Duration("write-timeout", time.Minute, "Maximum duration for writing a response.\nFile contents are exempt so that large downloads are not interrupted.")
+	idleTimeout       = flag.Duration("idle-timeout", 2*time.Minute, "Maximum duration to wait for the next request on a keep-alive connection.")
+	tcpKeepAlive      = flag.Duration("tcp-keepalive", 15*time.Second, "Period between TCP keep-alive probes on accepted connections.\nA negative value disables keep-alive probes.")
+	tcpNoDelay        = flag.Bool("tcp-nodelay", true, "Set TCP_NODELAY on accepted connections to disable Nagle's algorithm.")
+	tcpReadBuffer     = flag.Int("tcp-read-buffer", 0, "Size in bytes of the socket receive buffer for accepted connections.\n(default determined by the operating system)")
+	tcpWriteBuffer    = flag.Int("tcp-write-buffer", 0, "Size in bytes of the socket send buffer for accepted connections.\n(default determined by the operating system)")
+	maxConns          = flag.Int("max-connections", 0, "Maximum number of requests served concurrently.\nRequests beyond the limit report StatusServiceUnavailable. (default unlimited)")
+	logJSON           = flag.Bool("log-json", false, "Format log messages as JSON instead of text.")
+	verbose           = flag.Bool("verbose", false, "Log every HTTP request. Equivalent to -log-level=debug.")
+
+	appendRx      *regexp.Regexp
+	appendRoot    *os.Root
+	audit         *auditLog
+	trustedNets   []*net.IPNet
+	logger        *slog.Logger
+	faviconAsset  = newStaticAsset("favicon.ico", defaultFavicon, "public, max-age=31536000, immutable")
+	robotsAsset   *staticAsset
+	pageTemplates *template.Template
+	dispositions  map[string]string // file extension to Content-Disposition type
+	indexFiles    []string          // names of index files in order of priority
+	connSema      chan struct{}
 )
 
 func main() {
@@ -51,54 +141,385 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
-	if *hide != "" {
-		hideRx, err = regexp.Compile(*hide)
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid config file: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	cfg := new(config)
+	for _, pf := range patternFlags {
+		s := flag.Lookup(pf.name).Value.String()
+		if *pf.field(cfg), err = compilePattern(s); err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid %s pattern: %v\n\n", pf.name, s)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	if *appendPat != "" {
+		appendRx, err = regexp.Compile(*appendPat)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid append pattern: %v\n\n", *appendPat)
+			flag.Usage()
+			os.Exit(1)
+		}
+		appendRoot, err = os.OpenRoot(*root)
 		if err != nil {
-			fmt.Fprintf(flag.CommandLine.Output(), "Invalid hide pattern: %v\n\n", *hide)
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid root directory for appending: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		allowedMethods += ", POST"
+	}
+	if *auditLogPath != "" {
+		if audit, err = openAuditLog(*auditLogPath, *auditFsync); err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid audit log: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	var logOpts slog.HandlerOptions
+	switch *logLevel {
+	case "error":
+		logOpts.Level = slog.LevelError
+	case "info":
+		logOpts.Level = slog.LevelInfo
+	case "debug":
+		logOpts.Level = slog.LevelDebug
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid log level: %v\n\n", *logLevel)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *verbose {
+		logOpts.Level = slog.LevelDebug
+	}
+	if *logJSON {
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, &logOpts))
+	} else {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &logOpts))
+	}
+	if pageTemplates, err = parseTemplates(*templateDir); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid template: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *sizeUnits != "iec" && *sizeUnits != "si" {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid size units: %v\n\n", *sizeUnits)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if !validSortOrder(*defaultSort) {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid default sort: %v\n\n", *defaultSort)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *dirsFirst && *dirsLast {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid arguments: -dirs-first and -dirs-last are mutually exclusive\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	for _, d := range []struct{ typ, exts string }{{"inline", *inlineTypes}, {"attachment", *attachmentTypes}} {
+		for _, ext := range strings.Split(d.exts, ",") {
+			if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" {
+				if dispositions == nil {
+					dispositions = make(map[string]string)
+				}
+				dispositions["."+strings.TrimPrefix(ext, ".")] = d.typ
+			}
+		}
+	}
+	for _, name := range strings.Split(*indexNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+				fmt.Fprintf(flag.CommandLine.Output(), "Invalid index name: %v\n\n", name)
+				flag.Usage()
+				os.Exit(1)
+			}
+			indexFiles = append(indexFiles, name)
+		}
+	}
+	if *copyBufSize <= 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid copy buffer size: %v\n\n", *copyBufSize)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *maxConns > 0 {
+		connSema = make(chan struct{}, *maxConns)
+	}
+	*prefix = cleanPrefix(*prefix)
+	if *authFile != "" {
+		if authUsers, err = readAuthFile(*authFile); err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid auth file: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		sessionSecret = []byte(*sessionKey)
+		if len(sessionSecret) == 0 {
+			sessionSecret = newSessionSecret()
+		}
+	}
+	if *totpSecret != "" {
+		if totpKey, err = parseTOTPSecret(*totpSecret); err != nil || authUsers == nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid TOTP secret: must be base32 encoded and requires -auth-file\n\n")
 			flag.Usage()
 			os.Exit(1)
 		}
 	}
-	if *deny != "" {
-		denyRx, err = regexp.Compile(*deny)
+	if *mintShare != "" {
+		if *shareSecret == "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid arguments: -mint-share requires -share-secret\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		fmt.Println(shareURL(*mintShare, time.Now().Add(*shareTTL), *sharePassword))
+		os.Exit(0)
+	}
+	if *trusted != "" {
+		for _, s := range strings.Split(*trusted, ",") {
+			s = strings.TrimSpace(s)
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				fmt.Fprintf(flag.CommandLine.Output(), "Invalid trusted proxy: %v\n\n", s)
+				flag.Usage()
+				os.Exit(1)
+			}
+			trustedNets = append(trustedNets, ipNet)
+		}
+	}
+	dir, err := openRoot(*root)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid root directory: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *favicon != "" {
+		b, err := os.ReadFile(*favicon)
 		if err != nil {
-			fmt.Fprintf(flag.CommandLine.Output(), "Invalid deny pattern: %v\n\n", *deny)
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid favicon: %v\n\n", err)
 			flag.Usage()
 			os.Exit(1)
 		}
+		faviconAsset = newStaticAsset("favicon.ico", b, "public, max-age=86400")
 	}
-	if *index != "" {
-		indexRx, err = regexp.Compile(*index)
+	switch *robots {
+	case "":
+	case "allow":
+		robotsAsset = newStaticAsset("robots.txt", []byte("User-agent: *\nDisallow:\n"), "public, max-age=86400")
+	case "deny":
+		robotsAsset = newStaticAsset("robots.txt", []byte("User-agent: *\nDisallow: /\n"), "public, max-age=86400")
+	default:
+		b, err := os.ReadFile(*robots)
 		if err != nil {
-			fmt.Fprintf(flag.CommandLine.Output(), "Invalid index pattern: %v\n\n", *index)
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid robots: %v\n\n", err)
 			flag.Usage()
 			os.Exit(1)
 		}
+		robotsAsset = newStaticAsset("robots.txt", b, "public, max-age=86400")
 	}
-	if _, err := os.Stat(*root); err != nil {
-		fmt.Fprintf(flag.CommandLine.Output(), "Invalid root directory: %v\n\n", err)
+	if *singleFile != "" {
+		if fi, err := os.Stat(*singleFile); err != nil || !fi.Mode().IsRegular() {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid single file: %v\n\n", *singleFile)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	if *overlay != "" {
+		layers := overlayFS{dir}
+		for _, name := range filepath.SplitList(*overlay) {
+			layer, err := openRoot(name)
+			if err != nil {
+				fmt.Fprintf(flag.CommandLine.Output(), "Invalid overlay directory: %v\n\n", err)
+				flag.Usage()
+				os.Exit(1)
+			}
+			layers = append(layers, layer)
+		}
+		dir = layers
+	}
+	if *fsTimeout > 0 {
+		dir = timeoutFS{dir, *fsTimeout}
+	}
+	if cfg.redirects, err = readRedirects(dir); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid redirects file: %v\n\n", err)
 		flag.Usage()
 		os.Exit(1)
 	}
-	dir := os.DirFS(*root)
+	currentConfig.Store(cfg)
+
+	// Reopen the audit log and reload the config and redirects files upon SIGHUP.
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			if audit != nil {
+				if err := audit.reopen(); err != nil {
+					logger.Error("audit log reopen error", "err", err)
+				}
+			}
+			if err := reloadConfig(*configFile, dir); err != nil {
+				logger.Error("config reload error", "err", err)
+			} else {
+				logger.Info("reloaded config", "path", *configFile, "redirects", len(currentConfig.Load().redirects))
+			}
+		}
+	}()
 
 	// Startup the file server.
 	var ln net.Listener
 	for {
 		var err error
-		ln, err = net.Listen("tcp", *addr)
+		lc := net.ListenConfig{KeepAlive: *tcpKeepAlive}
+		ln, err = lc.Listen(context.Background(), "tcp", *addr)
 		if err == nil {
+			ln = tcpListener{ln}
 			break
 		}
 		const retryPeriod = 30 * time.Second
-		log.Printf("net.Listen error: %v; retry in %v", err, retryPeriod)
+		logger.Error("net.Listen error", "err", err, "retry", retryPeriod)
 		time.Sleep(retryPeriod)
 	}
-	log.Printf("started up server on %v", *addr)
-	log.Fatal(http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	logger.Info("started up server", "addr", *addr)
+	stats.start = time.Now()
+	srv := &http.Server{
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	if *maxTotalRate > 0 {
+		totalRateLimiter = newRateLimiter(*maxTotalRate)
+	}
+	if *maxRate > 0 {
+		srv.ConnContext = withRateLimiter
+	}
+	srv.Handler = newHandler(dir)
+	err = srv.Serve(ln)
+	logger.Error("http.Serve error", "err", err)
+	os.Exit(1)
+}
+
+// apiPath is the prefix of paths that are served as JSON,
+// as if the request only accepted "application/json".
+const apiPath = "/.api"
+
+// newHandler returns the handler that serves the files in dir
+// according to the flags and the current config.
+func newHandler(dir fs.FS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Log the request after it has been served.
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w, plaintext: r.TLS == nil}
+		if *serverTiming {
+			rec.timer = &serverTimer{last: start}
+		}
+		w = rec
+		reqPath := r.URL.Path
+		stats.inFlight.Add(1)
+		defer func() {
+			if rec.status == 0 {
+				rec.setTimingHeader() // nothing was written (e.g., a HEAD request)
+			}
+			stats.inFlight.Add(-1)
+			recordStats(rec)
+			logger.Debug("request",
+				"method", r.Method,
+				"path", reqPath,
+				"status", rec.status,
+				"bytes", rec.bytes,
+				"duration_ms", time.Since(start).Milliseconds(),
+				"remote", r.RemoteAddr,
+			)
+		}()
+
+		// Use the same config for the entire request,
+		// even if it is concurrently reloaded.
+		cfg := currentConfig.Load()
+
+		// Recover from panics so that the client receives an error
+		// instead of having the connection abruptly closed.
+		defer func() {
+			if ex := recover(); ex != nil {
+				if ex == http.ErrAbortHandler {
+					panic(ex)
+				}
+				logger.Error("panic serving request",
+					"method", r.Method,
+					"path", r.URL.Path,
+					"remote", r.RemoteAddr,
+					"panic", ex,
+					"stack", string(debug.Stack()),
+				)
+				if rec.status == 0 {
+					httpError(w, r, errors.New("panic serving request"))
+				}
+			}
+		}()
+
+		// Limit the number of concurrently served requests.
+		if connSema != nil {
+			select {
+			case connSema <- struct{}{}:
+				defer func() { <-connSema }()
+			default:
+				w.Header().Set("Retry-After", "1")
+				httpError(w, r, errTooManyRequests)
+				return
+			}
+		}
+
 		// Never cache the server results. Consider it dynamically changing.
 		w.Header().Set("Cache-Control", "no-cache, no-store, no-transform, must-revalidate, private, max-age=0")
 
+		// Only serve the supported methods.
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, methodPropfind, http.MethodPost:
+		case http.MethodOptions:
+			w.Header().Set("Allow", allowedMethods)
+			w.Header().Set("DAV", "1")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			w.Header().Set("Allow", allowedMethods)
+			httpError(w, r, errMethodNotAllowed)
+			return
+		}
+
+		// Honor the external host as reported by a trusted proxy.
+		if h := r.Header.Get("X-Forwarded-Host"); h != "" && isTrustedProxy(r) {
+			r.Host = h
+		}
+
+		// Reject paths with NUL bytes or other control characters,
+		// which could confuse the operating system.
+		// This checks the decoded path since "%00" decodes to a NUL byte.
+		if strings.IndexFunc(r.URL.Path, isControl) >= 0 {
+			httpError(w, r, badRequestError("invalid character in path"))
+			return
+		}
+
+		// Strip the prefix that the server is mounted under.
+		// A request for the prefix itself is redirected to the root directory.
+		if *prefix != "" {
+			if r.URL.Path == *prefix {
+				relativeRedirect(w, r, path.Base(*prefix)+"/")
+				return
+			}
+			if !strings.HasPrefix(r.URL.Path, *prefix+"/") {
+				httpError(w, r, os.ErrNotExist)
+				return
+			}
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, *prefix)
+		}
+
 		// For simplicity, always deal with clean paths that are absolute.
 		// If the path had a trailing slash, preserve it.
 		hadSlashSuffix := strings.HasSuffix(r.URL.Path, "/")
@@ -107,14 +528,120 @@ func main() {
 			r.URL.Path += "/"
 		}
 
-		// Log the request.
-		if *verbose {
-			log.Printf("%s %s", r.Method, r.URL.Path)
+		// As defense in depth, reject paths that could escape the root.
+		// After cleaning, the path is absolute and free of "." and ".."
+		// elements, except for malformed paths without a leading slash
+		// (e.g., "../etc/passwd"), which path.Clean cannot fully resolve.
+		// Thus, any path that reaches the file system is within the root.
+		if hasDotDot(r.URL.Path) {
+			httpError(w, r, badRequestError("invalid path"))
+			return
+		}
+
+		// Serve paths under the API prefix as JSON (e.g., listings and errors).
+		// A request for the prefix itself is redirected to the root directory.
+		if r.URL.Path == apiPath {
+			relativeRedirect(w, r, path.Base(apiPath)+"/")
+			return
+		}
+		if p, ok := strings.CutPrefix(r.URL.Path, apiPath+"/"); ok {
+			r.URL.Path = "/" + p
+			r.Header.Set("Accept", "application/json")
+		}
+
+		// Serve a file through a signed share link.
+		if *shareSecret != "" && r.URL.Path == sharePath {
+			serveShare(w, r, dir)
+			return
+		}
+
+		// Require a login if enabled.
+		if authUsers != nil {
+			switch r.URL.Path {
+			case loginPath:
+				serveLogin(w, r)
+				return
+			case logoutPath:
+				serveLogout(w, r)
+				return
+			}
+			if _, ok := sessionUser(r); !ok {
+				requireLogin(w, r)
+				return
+			}
+		}
+
+		// Serve the same file for every request path,
+		// which is only reached after any required login.
+		if *singleFile != "" {
+			f, err := os.Open(*singleFile)
+			if err != nil {
+				httpError(w, r, err)
+				return
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				httpError(w, r, err)
+				return
+			}
+			r.URL.Path = "/" + fi.Name() // determines the Content-Type
+			serveFile(w, r, f, fi.ModTime())
+			return
+		}
+
+		// Report statistics about the server.
+		if r.URL.Path == statusPath {
+			serveStatus(w, r)
+			return
+		}
+
+		// Report information about many files at once.
+		if r.URL.Path == statPath {
+			serveStat(w, r, cfg, dir)
+			return
+		}
+
+		// Append the request body to a file.
+		if r.Method == http.MethodPost {
+			serveAppend(w, r, cfg)
+			return
+		}
+
+		reqPath = r.URL.Path
+
+		// Redirect paths according to the forced rules in the redirects file,
+		// regardless of whether a file exists at the path.
+		if to, status, ok := matchRedirect(cfg.redirects, r.URL.Path, true); ok {
+			serveRedirect(w, r, to, status)
+			return
+		}
+
+		// Pretend that the redirects file does not exist,
+		// similar to hidden paths with -hide-strict.
+		if isRedirectsFile(r.URL.Path) {
+			httpError(w, r, os.ErrNotExist)
+			return
 		}
 
 		// Verify that the file exists.
-		f, err := dir.Open(filepath.Join(".", filepath.FromSlash(r.URL.Path)))
+		name := filepath.Join(".", filepath.FromSlash(r.URL.Path))
+		logger.Debug("open", "path", filepath.Join(*root, name))
+		f, err := dir.Open(name)
 		if err != nil {
+			// Redirect paths that do not exist according to any rule.
+			if to, status, ok := matchRedirect(cfg.redirects, r.URL.Path, false); ok && os.IsNotExist(err) {
+				serveRedirect(w, r, to, status)
+				return
+			}
+			if r.URL.Path == "/favicon.ico" && os.IsNotExist(err) {
+				faviconAsset.serve(w, r)
+				return
+			}
+			if r.URL.Path == "/robots.txt" && os.IsNotExist(err) && robotsAsset != nil {
+				robotsAsset.serve(w, r)
+				return
+			}
 			httpError(w, r, err)
 			return
 		}
@@ -125,6 +652,38 @@ func main() {
 			return
 		}
 
+		// With strict hiding, pretend that hidden paths do not exist.
+		if *hideStrict && strictlyHidden(cfg, r.URL.Path) {
+			httpError(w, r, os.ErrNotExist)
+			return
+		}
+
+		// Serve WebDAV property requests, where clients do not
+		// necessarily use a trailing slash for directories.
+		if r.Method == methodPropfind {
+			if fi.IsDir() && !strings.HasSuffix(r.URL.Path, "/") {
+				r.URL.Path += "/"
+			}
+			if regexpMatch(cfg.denyRx, r.URL.Path) {
+				httpError(w, r, errDenied())
+				return
+			}
+			servePropfind(w, r, cfg, dir, fi)
+			return
+		}
+
+		// Reject paths that match the deny pattern.
+		// This checks the path with the trailing slash it would be
+		// redirected to, so that the redirect does not reveal the path.
+		canonPath := strings.TrimSuffix(r.URL.Path, "/")
+		if fi.IsDir() {
+			canonPath += "/"
+		}
+		if regexpMatch(cfg.denyRx, canonPath) {
+			httpError(w, r, errDenied())
+			return
+		}
+
 		// Check that there is a trailing slash for only directories.
 		if fi.IsDir() != strings.HasSuffix(r.URL.Path, "/") {
 			if fi.IsDir() {
@@ -136,22 +695,39 @@ func main() {
 			}
 		}
 
-		// Reject paths that match the deny pattern.
-		if regexpMatch(denyRx, r.URL.Path) {
-			httpError(w, r, os.ErrPermission)
+		// Serve either a directory or a file.
+		markTiming(w, "resolve")
+		if r.URL.Query().Has("qr") {
+			serveQR(w, r)
 			return
 		}
-
-		// Serve either a directory or a file.
 		if fi.IsDir() {
-			serveDirectory(w, r, dir, f)
+			if (r.URL.Query().Has("recent") || r.URL.Query().Has("dupes") || r.URL.Query().Has("du")) && listingDisabled(dir, r.URL.Path) {
+				httpError(w, r, errListingDisabled)
+				return
+			}
+			if r.URL.Query().Has("recent") {
+				serveRecent(w, r, cfg, dir)
+				return
+			}
+			if r.URL.Query().Has("dupes") {
+				serveDupes(w, r, cfg, dir)
+				return
+			}
+			if r.URL.Query().Has("du") {
+				serveDiskUsage(w, r, cfg, dir, fi)
+				return
+			}
+			serveDirectory(w, r, cfg, dir, f)
+		} else if regexpMatch(cfg.indexRx, r.URL.Path) || slices.Contains(indexFiles, path.Base(r.URL.Path)) {
+			relativeRedirect(w, r, "./") // redirect to directory containing index.html
 		} else {
-			serveFile(w, r, f, fi.ModTime(), true)
+			serveFile(w, r, f, fi.ModTime())
 		}
-	})))
+	})
 }
 
-func serveDirectory(w http.ResponseWriter, r *http.Request, dir fs.FS, f fs.File) {
+func serveDirectory(w http.ResponseWriter, r *http.Request, cfg *config, dir fs.FS, f fs.File) {
 	// Read the directory entries, resolving any symbolic links,
 	// and sorting all the entries by name.
 	fd, ok := f.(fs.ReadDirFile)
@@ -167,39 +743,104 @@ func serveDirectory(w http.ResponseWriter, r *http.Request, dir fs.FS, f fs.File
 	sort.Slice(fes, func(i, j int) bool {
 		return fes[i].Name() < fes[j].Name()
 	})
+	w.Header().Add("Vary", "Accept")
+	format, err := listingFormat(r)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
 
-	type fileInfo struct {
-		Name    string
-		Size    int64
-		ModTime time.Time
+	showHidden := r.URL.Query().Has("hidden")
+	if showHidden && !*listHidden {
+		httpError(w, r, fmt.Errorf("%w: hidden files may not be listed", fs.ErrPermission))
+		return
 	}
+
 	var fis []fileInfo
+	var readmeText, dirTitle string
+	disabled := *noIndex
+	names := make(map[string]bool)
+	for _, fe := range fes {
+		names[fe.Name()] = true
+	}
+
+	// Serve the index file with the highest priority, if any.
+	// This is independent of the order of the directory entries.
+	for _, name := range indexFiles {
+		urlPath := r.URL.Path + name
+		if !names[name] || regexpMatch(cfg.denyRx, urlPath) || regexpMatch(cfg.hideRx, urlPath) {
+			continue
+		}
+		f, err := dir.Open(filepath.Join(".", filepath.FromSlash(urlPath)))
+		if err != nil {
+			continue // e.g., a broken symbolic link
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			logger.Debug("serving index file", "path", urlPath)
+			r.URL.Path = urlPath
+			serveFile(w, r, f, fi.ModTime())
+			return
+		}
+	}
+
 	for _, fe := range fes {
+		// Exclude sidecar files for entries that exist.
+		if *sidecars && strings.HasSuffix(fe.Name(), sidecarSuffix) && names[strings.TrimSuffix(fe.Name(), sidecarSuffix)] {
+			continue
+		}
+
 		// Obtain the fs.FileInfo, resolving symbolic links if necessary.
+		// Broken symbolic links are listed using information about the link.
 		var fi fs.FileInfo
+		var broken bool
 		if fe.Type()&os.ModeSymlink == 0 {
 			fi, _ = fe.Info()
 		} else {
 			fi, _ = fs.Stat(dir, filepath.Join(".", filepath.FromSlash(r.URL.Path), fe.Name()))
+			if fi == nil {
+				fi, _ = fe.Info()
+				broken = true
+			}
 		}
 		if fi == nil {
 			continue
 		}
 
 		// Check whether to hide or specially handle this file.
-		urlPath := r.URL.Path + "/" + fi.Name()
-		if regexpMatch(hideRx, urlPath) || regexpMatch(denyRx, urlPath) {
+		urlPath := r.URL.Path + fi.Name()
+		if isRedirectsFile(urlPath) {
+			continue
+		}
+		if fi.Name() == noIndexFile && fi.Mode().IsRegular() {
+			disabled = true
+			continue
+		}
+		if regexpMatch(cfg.denyRx, urlPath) {
+			continue
+		}
+		if fi.Name() == titleFile && fi.Mode().IsRegular() {
+			dirTitle, _, _ = strings.Cut(strings.TrimSpace(readFileText(dir, filepath.Join(".", filepath.FromSlash(r.URL.Path), fi.Name()))), "\n")
+			dirTitle = strings.TrimSpace(dirTitle)
+			continue
+		}
+		if regexpMatch(cfg.readmeRx, urlPath) && fi.Mode().IsRegular() && readmeText == "" {
+			readmeText = readFileText(dir, filepath.Join(".", filepath.FromSlash(r.URL.Path), fi.Name()))
+		}
+		hidden := regexpMatch(cfg.hideRx, urlPath)
+		if hidden && !showHidden {
 			continue
 		}
-		if regexpMatch(indexRx, urlPath) {
+		if regexpMatch(cfg.indexRx, urlPath) && !broken {
 			f, err := dir.Open(filepath.Join(".", filepath.FromSlash(r.URL.Path), fi.Name()))
 			if err != nil {
 				httpError(w, r, err)
 				return
 			}
 			defer f.Close()
+			logger.Debug("serving index file", "path", urlPath)
 			r.URL.Path = urlPath
-			serveFile(w, r, f, fi.ModTime(), false)
+			serveFile(w, r, f, fi.ModTime())
 			return
 		}
 
@@ -211,45 +852,589 @@ func serveDirectory(w http.ResponseWriter, r *http.Request, dir fs.FS, f fs.File
 		if fi.Mode().IsRegular() {
 			size = fi.Size()
 		}
-		fis = append(fis, fileInfo{Name: name, Size: size, ModTime: fi.ModTime()})
+		var link string
+		var escapes bool
+		if *links && fe.Type()&os.ModeSymlink != 0 {
+			link, escapes = readLink(dir, path.Join(".", r.URL.Path, fe.Name()))
+		}
+		var meta sidecarMeta
+		if *sidecars && names[fi.Name()+sidecarSuffix] {
+			meta = readSidecar(dir, filepath.Join(".", filepath.FromSlash(r.URL.Path), fi.Name()+sidecarSuffix))
+		}
+		fis = append(fis, fileInfo{Name: name, Mode: fi.Mode(), Size: size, ModTime: fi.ModTime(), Kind: fileKind(name), sidecarMeta: meta, Broken: broken, Link: link, Escapes: escapes, Hidden: hidden})
+		if uid, gid, ok := fileOwner(fi); ok && *showOwner {
+			fe := &fis[len(fis)-1]
+			fe.UID, fe.GID, fe.User, fe.Group = &uid, &gid, userName(uid), groupName(gid)
+		}
+		if n, ok := fileLinkCount(fi); ok && *showLinkCount {
+			fis[len(fis)-1].LinkCount = n
+		}
+	}
+	markTiming(w, "readdir")
+	if disabled {
+		httpError(w, r, errListingDisabled)
+		return
+	}
+
+	// Sort the entries.
+	var dirs int
+	switch {
+	case *dirsFirst:
+		dirs = -1
+	case *dirsLast:
+		dirs = +1
+	}
+	switch group := r.URL.Query().Get("group"); group {
+	case "":
+	case "dirs":
+		dirs = -1
+	case "dirs-last":
+		dirs = +1
+	case "none":
+		dirs = 0
+	default:
+		httpError(w, r, badRequestError(fmt.Sprintf("invalid group %q", group)))
+		return
+	}
+	order := *defaultSort
+	if q := r.URL.Query().Get("sort"); q != "" {
+		if !validSortOrder(q) {
+			httpError(w, r, badRequestError(fmt.Sprintf("invalid sort %q", q)))
+			return
+		}
+		order = q
+	}
+	sortFiles(fis, order, dirs)
+
+	// Filter the entries by name if requested.
+	numTotal := len(fis)
+	filter := r.URL.Query().Get("filter")
+	if filter != "" {
+		icase, _ := strconv.ParseBool(r.URL.Query().Get("filter-icase"))
+		match, err := newNameFilter(filter, r.URL.Query().Get("filter-mode"), icase)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		var matched []fileInfo
+		for _, fi := range fis {
+			if match(strings.TrimSuffix(fi.Name, "/")) {
+				matched = append(matched, fi)
+			}
+		}
+		fis = matched
+	}
+
+	// Limit the number of entries, starting from the requested offset.
+	numMatched := len(fis)
+	var offset int
+	if q := r.URL.Query().Get("offset"); q != "" {
+		if offset, err = strconv.Atoi(q); err != nil || offset < 0 {
+			httpError(w, r, badRequestError("offset must be a non-negative integer"))
+			return
+		}
+	}
+	fis = fis[min(offset, len(fis)):]
+	var next string // URL of the next page of entries
+	if *maxListEntries > 0 && len(fis) > *maxListEntries {
+		fis = fis[:*maxListEntries]
+		q := r.URL.Query()
+		q.Set("offset", strconv.Itoa(offset+len(fis)))
+		next = "?" + q.Encode()
+		w.Header().Set("Link", "<"+next+`>; rel="next"`) // for text and long listings
+	}
+
+	var numImages, numMedia int
+	for i := range fis {
+		if !strings.HasSuffix(fis[i].Name, "/") {
+			fis[i].SizeText = formatSize(fis[i].Size)
+		}
+		if (format == "html" || format == "json") && numImages < *imageDimsMax &&
+			fis[i].Mode.IsRegular() && fis[i].Size <= maxImageSize && hasImageConfig(fis[i].Name) {
+			c := readImageConfig(dir, filepath.Join(".", filepath.FromSlash(r.URL.Path), fis[i].Name), fis[i].ModTime)
+			fis[i].Width, fis[i].Height = c.Width, c.Height
+			numImages++
+		}
+		if (format == "html" || format == "json") && numMedia < *mediaDurMax &&
+			fis[i].Mode.IsRegular() && hasMediaDuration(fis[i].Name) {
+			fis[i].Duration = readMediaDuration(dir, filepath.Join(".", filepath.FromSlash(r.URL.Path), fis[i].Name), fis[i].ModTime).Seconds()
+			numMedia++
+		}
+	}
+
+	// Prepend a synthetic entry for the parent directory if requested.
+	// It is not counted as one of the entries shown.
+	numShown := len(fis)
+	if *parentEntry && r.URL.Path != "/" {
+		parent := fileInfo{Name: "../", Mode: fs.ModeDir, Kind: "folder"}
+		if fi, err := fs.Stat(dir, filepath.Join(".", filepath.FromSlash(r.URL.Path), "..")); err == nil {
+			parent.Mode, parent.ModTime = fi.Mode(), fi.ModTime()
+		}
+		fis = append([]fileInfo{parent}, fis...)
 	}
 
 	// Format the list of files and folders.
-	renderHTML(w, r, func(w io.Writer) {
-		io.WriteString(w, "<table>\n")
-		io.WriteString(w, "<thead>\n")
-		io.WriteString(w, "<tr>\n")
-		io.WriteString(w, "<th>Name</th>\n")
-		io.WriteString(w, "<th>Size</th>\n")
-		io.WriteString(w, "<th>Last Modified</th>\n")
-		io.WriteString(w, "</tr>\n")
-		io.WriteString(w, "</thead>\n")
-		io.WriteString(w, "<tbody>\n")
-		now := time.Now()
+	switch format {
+	case "json":
+		b, err := json.Marshal(struct {
+			Entries   []fileInfo `json:"entries"`
+			Total     int        `json:"total"`
+			Matched   int        `json:"matched"` // number of entries matching the filter
+			Truncated bool       `json:"truncated,omitempty"`
+			Next      string     `json:"next,omitempty"` // URL of the next page of entries
+			Readme    string     `json:"readme,omitempty"`
+		}{append([]fileInfo{}, fis...), numTotal, numMatched, next != "", next, readmeText})
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(b, '\n'))
+		return
+	case "text":
+		var bb bytes.Buffer
 		for _, fi := range fis {
-			urlString := (&url.URL{Path: fi.Name}).String()
-			io.WriteString(w, "<tr>\n")
-			io.WriteString(w, "<td>")
-			io.WriteString(w, `<a href="`+html.EscapeString(urlString)+`">`+html.EscapeString(fi.Name)+`</a>`)
-			io.WriteString(w, "</td>\n")
-			io.WriteString(w, "<td>")
-			if !strings.HasSuffix(fi.Name, "/") {
-				io.WriteString(w, html.EscapeString(formatSize(fi.Size)))
-			}
-			io.WriteString(w, "</td>\n")
-			io.WriteString(w, "<td>")
-			io.WriteString(w, html.EscapeString(formatTime(fi.ModTime, now)))
-			io.WriteString(w, "</td>\n")
-			io.WriteString(w, "</tr>\n")
-		}
-		io.WriteString(w, "</tbody>\n")
-		io.WriteString(w, "</table>\n")
+			bb.WriteString(fi.Name + "\n")
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(bb.Bytes())
+		return
+	case "long":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(formatLong(fis))
+		return
+	}
+	renderTemplate(w, r, http.StatusOK, dirTitle, "body.html", listingPage{
+		Entries:    fis,
+		Filter:     filter,
+		Shown:      numShown,
+		Matched:    numMatched,
+		Total:      numTotal,
+		Next:       next,
+		Sidecars:   *sidecars,
+		Owners:     *showOwner,
+		LinkCounts: *showLinkCount,
+		Readme:     readmeText,
+		Now:        time.Now(),
+	})
+}
+
+// titleFile is the name of a file that specifies the custom title
+// of the directory it is in. It is never listed.
+const titleFile = ".title"
+
+// strictlyHidden reports whether the URL path or any of its parent
+// directories matches the hide pattern, unless the URL path itself
+// matches the allow-direct pattern.
+func strictlyHidden(cfg *config, urlPath string) bool {
+	if regexpMatch(cfg.allowDirectRx, urlPath) {
+		return false
+	}
+	for i := 1; i <= len(urlPath); i++ {
+		if i < len(urlPath) && urlPath[i-1] != '/' && urlPath[i] != '/' {
+			continue // only check whole path elements, with and without a trailing slash
+		}
+		if p := urlPath[:i]; p != "/" && regexpMatch(cfg.hideRx, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// noIndexFile is the name of a file that disables the listing
+// of the directory it is in, similar to -no-index. It is never listed.
+const noIndexFile = ".noindex"
+
+// listingDisabled reports whether the listing of the directory
+// at the URL path is disabled, either by -no-index or a noIndexFile.
+func listingDisabled(dir fs.FS, urlPath string) bool {
+	if *noIndex {
+		return true
+	}
+	fi, err := fs.Stat(dir, filepath.Join(".", filepath.FromSlash(urlPath), noIndexFile))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// fileInfo is an entry in a directory listing.
+type fileInfo struct {
+	Name     string      `json:"name"` // has a trailing slash for directories
+	Mode     fs.FileMode `json:"-"`
+	Size     int64       `json:"size"`
+	SizeText string      `json:"sizeText,omitempty"`
+	ModTime  time.Time   `json:"modTime"`
+	Kind     string      `json:"kind"` // see fileKind
+	Width    int         `json:"width,omitempty"`
+	Height   int         `json:"height,omitempty"`
+	Duration float64     `json:"duration,omitempty"` // in seconds
+	sidecarMeta
+	Broken  bool   `json:"broken,omitempty"` // symbolic link with a target that does not exist
+	Link    string `json:"link,omitempty"`
+	Escapes bool   `json:"escapes,omitempty"` // symbolic link with a target outside the root directory
+	Hidden  bool   `json:"hidden,omitempty"`  // matches the hide pattern, but listed due to ?hidden=true
+
+	// The owner of the file if -show-owner is set.
+	UID   *int   `json:"uid,omitempty"`
+	GID   *int   `json:"gid,omitempty"`
+	User  string `json:"user,omitempty"`  // name of the UID
+	Group string `json:"group,omitempty"` // name of the GID
+
+	// The number of hard links to the file if -show-link-count is set.
+	LinkCount int `json:"nlink,omitempty"`
+}
+
+// fileKinds maps lowercase file extensions to the kind of file.
+var fileKinds = map[string]string{
+	".apng": "image", ".avif": "image", ".bmp": "image", ".gif": "image",
+	".heic": "image", ".ico": "image", ".jpeg": "image", ".jpg": "image",
+	".png": "image", ".svg": "image", ".tif": "image", ".tiff": "image",
+	".webp": "image",
+
+	".avi": "video", ".m4v": "video", ".mkv": "video", ".mov": "video",
+	".mp4": "video", ".mpeg": "video", ".mpg": "video", ".ogv": "video",
+	".webm": "video", ".wmv": "video",
+
+	".aac": "audio", ".flac": "audio", ".m4a": "audio", ".mid": "audio",
+	".mp3": "audio", ".oga": "audio", ".ogg": "audio", ".opus": "audio",
+	".wav": "audio", ".weba": "audio", ".wma": "audio",
+
+	".7z": "archive", ".bz2": "archive", ".gz": "archive", ".iso": "archive",
+	".jar": "archive", ".lz": "archive", ".lz4": "archive", ".rar": "archive",
+	".tar": "archive", ".tbz2": "archive", ".tgz": "archive", ".txz": "archive",
+	".xz": "archive", ".zip": "archive", ".zst": "archive",
+
+	".c": "code", ".cc": "code", ".cpp": "code", ".cs": "code", ".css": "code",
+	".go": "code", ".h": "code", ".hpp": "code", ".htm": "code",
+	".html": "code", ".java": "code", ".js": "code", ".json": "code",
+	".kt": "code", ".lua": "code", ".mjs": "code", ".php": "code",
+	".pl": "code", ".py": "code", ".rb": "code", ".rs": "code", ".sh": "code",
+	".sql": "code", ".swift": "code", ".toml": "code", ".ts": "code",
+	".tsx": "code", ".xml": "code", ".yaml": "code", ".yml": "code",
+
+	".csv": "document", ".doc": "document", ".docx": "document",
+	".epub": "document", ".md": "document", ".odp": "document",
+	".ods": "document", ".odt": "document", ".pdf": "document",
+	".ppt": "document", ".pptx": "document", ".rtf": "document",
+	".tex": "document", ".txt": "document", ".xls": "document",
+	".xlsx": "document",
+}
+
+// fileKind classifies a file by the extension of its name as either
+// "folder" (if the name has a trailing slash), "image", "video", "audio",
+// "archive", "code", "document", or "other".
+// Clients may use the kind to show an icon for the file.
+func fileKind(name string) string {
+	if strings.HasSuffix(name, "/") {
+		return "folder"
+	}
+	if kind := fileKinds[strings.ToLower(path.Ext(name))]; kind != "" {
+		return kind
+	}
+	return "other"
+}
+
+// listingFormat reports the format of a directory listing,
+// which is either "html", "json", "text", or "long". It is determined by
+// the "format" query parameter, otherwise by the Accept header.
+func listingFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "html", "json", "text", "long":
+		return format, nil
+	case "":
+		switch negotiateType(r, "text/html", "application/json", "text/plain") {
+		case "application/json":
+			return "json", nil
+		case "text/plain":
+			return "text", nil
+		default:
+			return "html", nil
+		}
+	default:
+		return "", badRequestError(fmt.Sprintf("invalid format %q", format))
+	}
+}
+
+// validSortOrder reports whether order is a valid order for sortFiles.
+func validSortOrder(order string) bool {
+	switch key, _ := strings.CutSuffix(order, "-desc"); key {
+	case "name", "natural", "size", "date":
+		return true
+	default:
+		return false
+	}
+}
+
+// sortFiles sorts the entries by the specified order, which is either
+// "name", "natural", "size", or "date", optionally with a "-desc" suffix.
+// Ties are broken by name. Directories are grouped before all files
+// if dirs is negative, or after all files if dirs is positive.
+func sortFiles(fis []fileInfo, order string, dirs int) {
+	key, desc := strings.CutSuffix(order, "-desc")
+	compareNames := strings.Compare
+	if key == "natural" || *sortNatural {
+		compareNames = compareNatural
+	}
+	sort.SliceStable(fis, func(i, j int) bool {
+		fi, fj := fis[i], fis[j]
+		if isDir, isDirJ := strings.HasSuffix(fi.Name, "/"), strings.HasSuffix(fj.Name, "/"); isDir != isDirJ && dirs != 0 {
+			return isDir == (dirs < 0)
+		}
+		var c int
+		switch key {
+		case "size":
+			c = cmp.Compare(fi.Size, fj.Size)
+		case "date":
+			c = fi.ModTime.Compare(fj.ModTime)
+		}
+		if c == 0 {
+			c = compareNames(strings.TrimSuffix(fi.Name, "/"), strings.TrimSuffix(fj.Name, "/"))
+		}
+		if desc {
+			c = -c
+		}
+		return c < 0
 	})
 }
 
-func serveFile(w http.ResponseWriter, r *http.Request, f fs.File, modTime time.Time, allowRedirect bool) {
-	if allowRedirect && regexpMatch(indexRx, r.URL.Path) {
-		relativeRedirect(w, r, "./") // redirect to directory containing index.html
+// compareNatural compares two names similar to strings.Compare,
+// except that runs of decimal digits are compared by numeric value.
+// Numbers that are equal in value but differ in leading zeros
+// are ordered lexically (e.g., "file01" before "file1").
+func compareNatural(x, y string) int {
+	isDigit := func(c byte) bool { return '0' <= c && c <= '9' }
+	digits := func(s string) int {
+		n := 0
+		for n < len(s) && isDigit(s[n]) {
+			n++
+		}
+		return n
+	}
+	s, t := x, y
+	for s != "" && t != "" {
+		if isDigit(s[0]) && isDigit(t[0]) {
+			n, m := digits(s), digits(t)
+			u, v := strings.TrimLeft(s[:n], "0"), strings.TrimLeft(t[:m], "0")
+			if c := cmp.Compare(len(u), len(v)); c != 0 {
+				return c
+			}
+			if c := strings.Compare(u, v); c != 0 {
+				return c
+			}
+			s, t = s[n:], t[m:]
+			continue
+		}
+		if s[0] != t[0] {
+			return cmp.Compare(s[0], t[0])
+		}
+		s, t = s[1:], t[1:]
+	}
+	if c := cmp.Compare(len(s), len(t)); c != 0 {
+		return c // the shorter name is a prefix of the other
+	}
+	return strings.Compare(x, y)
+}
+
+// formatLong formats the entries similar to "ls -l" with aligned columns
+// for the mode, owner (if known), size, modification time, and name
+// of each entry.
+func formatLong(fis []fileInfo) []byte {
+	var modeWidth, linkWidth, userWidth, groupWidth, sizeWidth int
+	for _, fi := range fis {
+		modeWidth = max(modeWidth, len(fi.Mode.String()))
+		if fi.LinkCount > 0 {
+			linkWidth = max(linkWidth, len(strconv.Itoa(fi.LinkCount)))
+		}
+		userWidth = max(userWidth, len(fi.User))
+		groupWidth = max(groupWidth, len(fi.Group))
+		sizeWidth = max(sizeWidth, len(strconv.FormatInt(fi.Size, 10)))
+	}
+	var bb bytes.Buffer
+	for _, fi := range fis {
+		fmt.Fprintf(&bb, "%-*s ", modeWidth, fi.Mode)
+		if linkWidth > 0 {
+			fmt.Fprintf(&bb, "%*d ", linkWidth, fi.LinkCount)
+		}
+		if userWidth > 0 {
+			fmt.Fprintf(&bb, "%-*s %-*s ", userWidth, fi.User, groupWidth, fi.Group)
+		}
+		fmt.Fprintf(&bb, "%*d %s %s", sizeWidth, fi.Size, fi.ModTime.UTC().Format("2006-01-02 15:04"), fi.Name)
+		if fi.Link != "" {
+			bb.WriteString(" -> " + fi.Link)
+		}
+		bb.WriteByte('\n')
+	}
+	return bb.Bytes()
+}
+
+// newNameFilter returns a function that reports whether a file name
+// matches the pattern according to the filter mode, which is either
+// "glob" (as understood by path.Match), "substr", or "regex".
+// If icase is specified, then matching is case-insensitive.
+//
+// Regular expressions are limited in length, but are otherwise safe
+// from pathological patterns since Go's regexp package guarantees
+// matching in time linear in the size of the input.
+func newNameFilter(pattern, mode string, icase bool) (func(string) bool, error) {
+	const maxRegexpLen = 256
+	if icase && mode != "regex" {
+		pattern = strings.ToLower(pattern)
+	}
+	var match func(string) bool
+	switch mode {
+	case "", "glob":
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, badRequestError(fmt.Sprintf("invalid filter %q: %v", pattern, err))
+		}
+		match = func(name string) bool {
+			ok, _ := path.Match(pattern, name)
+			return ok
+		}
+	case "substr":
+		match = func(name string) bool {
+			return strings.Contains(name, pattern)
+		}
+	case "regex":
+		if len(pattern) > maxRegexpLen {
+			return nil, badRequestError(fmt.Sprintf("invalid filter: regular expression exceeds %d bytes", maxRegexpLen))
+		}
+		if icase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, badRequestError(fmt.Sprintf("invalid filter: %v", err))
+		}
+		return re.MatchString, nil
+	default:
+		return nil, badRequestError(fmt.Sprintf("invalid filter mode %q", mode))
+	}
+	if icase {
+		return func(name string) bool { return match(strings.ToLower(name)) }, nil
+	}
+	return match, nil
+}
+
+// serveAppend appends the request body to the file of the request path
+// using a single write, such that concurrent appends to the same file
+// are interleaved at the granularity of entire request bodies.
+// The file is resolved within the root directory using os.Root,
+// so symbolic links cannot be used to write outside the root.
+func serveAppend(w http.ResponseWriter, r *http.Request, cfg *config) {
+	if !regexpMatch(appendRx, r.URL.Path) || strings.HasSuffix(r.URL.Path, "/") || isRedirectsFile(r.URL.Path) {
+		w.Header().Set("Allow", strings.TrimSuffix(allowedMethods, ", POST"))
+		httpError(w, r, errMethodNotAllowed)
+		return
+	}
+	if regexpMatch(cfg.denyRx, r.URL.Path) {
+		httpError(w, r, errDenied())
+		return
+	}
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, *appendMax))
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	name := filepath.Join(".", filepath.FromSlash(r.URL.Path))
+	f, err := appendRoot.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("%w: %v", fs.ErrPermission, err) // e.g., path escapes the root or is a directory
+		}
+		httpError(w, r, err)
+		return
+	}
+	_, err = f.Write(b)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if audit != nil {
+		audit.record(r, http.StatusNoContent, len(b))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readLink reads the target of the named symbolic link in fsys,
+// and reports whether the target lexically resolves outside the root.
+// Absolute targets are always reported as resolving outside the root.
+// It reports no target if fsys cannot read symbolic links.
+func readLink(fsys fs.FS, name string) (target string, escapes bool) {
+	rfs, ok := fsys.(readLinkFS)
+	if !ok {
+		return "", false
+	}
+	target, err := rfs.ReadLink(name)
+	if err != nil {
+		return "", false
+	}
+	if path.IsAbs(filepath.ToSlash(target)) || filepath.IsAbs(target) {
+		return target, true
+	}
+	resolved := path.Join(path.Dir(name), filepath.ToSlash(target))
+	escapes = resolved == ".." || strings.HasPrefix(resolved, "../")
+	return target, escapes
+}
+
+const sidecarSuffix = ".meta.json"
+
+// sidecarMeta is the schema of a metadata sidecar file. For example:
+//
+//	{"description": "Sunset at the beach", "tags": ["vacation", "2021"]}
+type sidecarMeta struct {
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// readSidecar reads and validates the named metadata sidecar file,
+// reporting the zero value if it cannot be read or is malformed.
+func readSidecar(dir fs.FS, name string) (meta sidecarMeta) {
+	f, err := dir.Open(name)
+	if err != nil {
+		return sidecarMeta{}
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, 1<<16+1))
+	if err != nil || len(b) > 1<<16 {
+		return sidecarMeta{}
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&meta); err != nil || d.More() {
+		return sidecarMeta{}
+	}
+	for _, tag := range meta.Tags {
+		if tag == "" || strings.ContainsAny(tag, "\r\n") {
+			return sidecarMeta{}
+		}
+	}
+	return meta
+}
+
+// readFileText reads up to 1MiB of the named file as text,
+// reporting an empty string if it cannot be read.
+func readFileText(dir fs.FS, name string) string {
+	f, err := dir.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, 1<<20))
+	if err != nil {
+		return ""
+	}
+	return strings.ToValidUTF8(string(b), "\uFFFD")
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, f fs.File, modTime time.Time) {
+	switch view := r.URL.Query().Get("view"); view {
+	case "":
+	case "hex", "text":
+		serveFileView(w, r, f, modTime, view)
+		return
+	default:
+		httpError(w, r, badRequestError(fmt.Sprintf("invalid view %q", view)))
 		return
 	}
 	rs, ok := f.(io.ReadSeeker)
@@ -261,10 +1446,79 @@ func serveFile(w http.ResponseWriter, r *http.Request, f fs.File, modTime time.T
 		}
 		rs = bytes.NewReader(b)
 	}
-	if !*sendfile {
+	if typ := dispositions[strings.ToLower(path.Ext(r.URL.Path))]; typ != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(typ, map[string]string{"filename": path.Base(r.URL.Path)}))
+	}
+	if *sniffContent && w.Header().Get("Content-Type") == "" {
+		var buf [512]byte
+		n, _ := io.ReadFull(rs, buf[:])
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(buf[:n]))
+	}
+	var limiters []*rateLimiter
+	if l, ok := r.Context().Value(rateLimiterKey{}).(*rateLimiter); ok {
+		limiters = append(limiters, l)
+	}
+	if totalRateLimiter != nil {
+		limiters = append(limiters, totalRateLimiter)
+	}
+	if len(limiters) > 0 {
+		rs = &rateLimitedReader{r.Context(), rs, limiters} // also avoids using sendfile syscall
+	} else if !*sendfile {
 		rs = struct{ io.ReadSeeker }{rs} // drop ReadFrom method to avoid using sendfile syscall
 	}
+	http.NewResponseController(w).SetWriteDeadline(time.Time{}) // file contents are exempt from the write timeout
 	http.ServeContent(w, r, r.URL.Path, modTime, rs)
+	if err := disconnectError(w, r); err != nil {
+		logger.Debug("client disconnected", "path", r.URL.Path, "err", err)
+	}
+}
+
+// serveFileView serves up to view-limit bytes of the file as plain text,
+// either verbatim (view is "text") or as a hex dump (view is "hex").
+func serveFileView(w http.ResponseWriter, r *http.Request, f fs.File, modTime time.Time, view string) {
+	b, err := io.ReadAll(io.LimitReader(f, *viewMax))
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if view == "hex" {
+		var bb bytes.Buffer
+		d := hex.Dumper(&bb)
+		d.Write(b)
+		d.Close()
+		b = bb.Bytes()
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, r.URL.Path, modTime, bytes.NewReader(b))
+}
+
+// staticAsset is an in-memory file that never changes while the server
+// is running, which is served with a strong validator so that clients
+// may cache it according to its Cache-Control policy.
+type staticAsset struct {
+	name         string
+	data         []byte
+	etag         string
+	cacheControl string
+}
+
+func newStaticAsset(name string, data []byte, cacheControl string) *staticAsset {
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	return &staticAsset{name: name, data: data, etag: etag, cacheControl: cacheControl}
+}
+
+// serve serves the asset, reporting StatusNotModified
+// if the request has a matching If-None-Match header.
+func (a *staticAsset) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", a.cacheControl)
+	w.Header().Set("ETag", a.etag)
+	http.ServeContent(w, r, a.name, time.Time{}, bytes.NewReader(a.data))
 }
 
 func relativeRedirect(w http.ResponseWriter, r *http.Request, urlPath string) {
@@ -275,25 +1529,179 @@ func relativeRedirect(w http.ResponseWriter, r *http.Request, urlPath string) {
 	w.WriteHeader(http.StatusMovedPermanently)
 }
 
+// tcpListener configures the socket options of accepted TCP connections.
+type tcpListener struct{ net.Listener }
+
+func (ln tcpListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(*tcpNoDelay)
+		if *tcpReadBuffer > 0 {
+			tc.SetReadBuffer(*tcpReadBuffer)
+		}
+		if *tcpWriteBuffer > 0 {
+			tc.SetWriteBuffer(*tcpWriteBuffer)
+		}
+	}
+	return c, err
+}
+
+// responseRecorder records the status code and number of bytes
+// written to the underlying http.ResponseWriter.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	err    error        // first error encountered while writing
+	timer  *serverTimer // nil unless -server-timing is set
+
+	plaintext bool // connection is not encrypted, so sendfile may be used
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.setTimingHeader()
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.setTimingHeader()
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	rec.recordError(err)
+	return n, err
+}
+
+// ReadFrom forwards to the underlying io.ReaderFrom (if any)
+// so that the sendfile syscall may still be used for files
+// over plaintext connections. Otherwise (e.g., over TLS),
+// it copies using a buffer of the configured size.
+func (rec *responseRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if rec.status == 0 {
+		rec.setTimingHeader()
+		rec.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok && rec.plaintext && isFile(r) {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.CopyBuffer(struct{ io.Writer }{rec.ResponseWriter}, r, make([]byte, *copyBufSize))
+	}
+	rec.bytes += n
+	rec.recordError(err)
+	return n, err
+}
+
+func (rec *responseRecorder) recordError(err error) {
+	if rec.err == nil {
+		rec.err = err
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// isFile reports whether r is an *os.File, possibly wrapped by io.LimitReader.
+// Only such readers are eligible for the sendfile syscall.
+func isFile(r io.Reader) bool {
+	if lr, ok := r.(*io.LimitedReader); ok {
+		r = lr.R
+	}
+	_, ok := r.(*os.File)
+	return ok
+}
+
+// disconnectError reports a non-nil error if the client went away
+// while the response was being written (e.g., an aborted download).
+func disconnectError(w http.ResponseWriter, r *http.Request) error {
+	if rec, ok := w.(*responseRecorder); ok {
+		if errors.Is(rec.err, syscall.EPIPE) || errors.Is(rec.err, syscall.ECONNRESET) {
+			return rec.err
+		}
+	}
+	return r.Context().Err()
+}
+
+// cleanPrefix normalizes a URL path prefix such that it is either empty
+// or has a leading slash without a trailing slash (e.g., "/files").
+func cleanPrefix(s string) string {
+	if s = strings.Trim(path.Clean("/"+s), "/"); s == "" {
+		return ""
+	}
+	return "/" + s
+}
+
+// isControl reports whether r is an ASCII control character.
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// hasDotDot reports whether any element of the slash-separated path is "..".
+func hasDotDot(p string) bool {
+	for _, s := range strings.Split(p, "/") {
+		if s == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedProxy reports whether the request originates from a trusted proxy.
+func isTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, ipNet := range trustedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// externalPrefix reports the URL path prefix that the root directory is
+// externally reachable under. It includes the X-Forwarded-Prefix header
+// if the request originates from a trusted proxy.
+func externalPrefix(r *http.Request) string {
+	if p := r.Header.Get("X-Forwarded-Prefix"); p != "" && isTrustedProxy(r) {
+		return cleanPrefix(p) + *prefix
+	}
+	return *prefix
+}
+
 // regexpMatch is identical to r.MatchString(s),
 // but reports false if r is nil.
 func regexpMatch(r *regexp.Regexp, s string) bool {
 	return r != nil && r.MatchString(s)
 }
 
-// formatSize returns the formatted size with IEC prefixes.
-// E.g., 81533654 => 77.8MiB
+// formatSize returns the formatted size with either
+// IEC prefixes (e.g., 81533654 => 77.8MiB) or
+// SI prefixes (e.g., 81533654 => 81.5MB) according to the size-units flag.
 func formatSize(i int64) string {
-	units := "=KMGTPEZY"
+	units, base, suffix := "=KMGTPEZY", 1024.0, "iB"
+	if *sizeUnits == "si" {
+		units, base, suffix = "=kMGTPEZY", 1000.0, "B"
+	}
 	n := float64(i)
-	for n >= 1024 {
-		n /= 1024
+	for n >= base-0.05 { // e.g., 1023.96KiB is printed as 1.0MiB, not 1024.0KiB
+		n /= base
 		units = units[1:]
 	}
 	if units[0] == '=' {
 		return fmt.Sprintf("%dB", int(n))
 	} else {
-		return fmt.Sprintf("%0.1f%ciB", n, units[0])
+		return fmt.Sprintf("%0.1f%c%s", n, units[0], suffix)
 	}
 }
 
@@ -308,66 +1716,176 @@ func formatTime(ts, now time.Time) string {
 	}
 }
 
-func renderHTML(w http.ResponseWriter, r *http.Request, renderBody func(io.Writer)) {
-	var bb bytes.Buffer
-	bb.WriteString("<html lang=\"en\">\n")
-	bb.WriteString("<head>\n")
-	bb.WriteString(`<meta name="viewport" content="width=device-width, initial-scale=1">`)
-	bb.WriteString("<title>" + html.EscapeString(path.Base(r.URL.Path)) + "</title>\n")
-	bb.WriteString("<style>\n")
-	bb.WriteString("body { font-family: monospace; }\n")
-	bb.WriteString("h1 { margin: 0; }\n")
-	bb.WriteString("th, td { text-align: left; }\n")
-	bb.WriteString("th, td { padding-right: 2em; }\n")
-	bb.WriteString("th { padding-bottom: 0.5em; }\n")
-	bb.WriteString("a, a:visited, a:hover, a:active { color: blue; }\n")
-	bb.WriteString("</style>\n")
-	bb.WriteString("</head>\n")
-	bb.WriteString("<body>\n")
-
-	// Format the title.
-	bb.WriteString("<h1>")
+// renderHTML renders an HTML page for the request with the status code
+// and the body produced by renderBody. If non-empty, dirTitle is the custom
+// title of the requested directory (as specified by a title file).
+func renderHTML(w http.ResponseWriter, r *http.Request, code int, dirTitle string, renderBody func(io.Writer)) {
+	var body bytes.Buffer
+	renderBody(&body)
+	page := htmlPage{Title: path.Base(r.URL.Path), Body: template.HTML(body.String())}
+	if dirTitle != "" {
+		page.Title = dirTitle
+	}
+	if *title != "" {
+		page.Title = strings.ReplaceAll(*title, "{dir}", page.Title)
+	}
+	if user, ok := sessionUser(r); ok {
+		page.User, page.LogoutURL = user, externalPrefix(r)+logoutPath
+	}
+
+	// Format the title as links to the path and each of its parents.
 	names := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	names[0] = externalPrefix(r) // root is named after the prefix the server is mounted under
 	for i, name := range names {
-		if i > 0 {
-			bb.WriteString(" ")
-		}
 		name += "/"
 		urlString := "." + strings.Repeat("/..", len(names)-1-i)
 		if !strings.HasSuffix(r.URL.Path, "/") {
 			if i == len(names)-1 {
 				name = strings.TrimSuffix(name, "/")
-				urlString = path.Base(r.URL.Path)
+				urlString = (&url.URL{Path: path.Base(r.URL.Path)}).String()
 			} else {
 				urlString = strings.TrimSuffix(urlString, "/..")
 			}
 		}
-		bb.WriteString(`<a href="` + html.EscapeString(urlString) + `">` + html.EscapeString(name) + `</a>`)
+		if i == len(names)-1 && dirTitle != "" {
+			name = dirTitle
+		}
+		page.Breadcrumbs = append(page.Breadcrumbs, breadcrumb{Name: name, URL: urlString})
 	}
-	bb.WriteString("</h1>\n")
-	bb.WriteString("<hr>\n")
 
-	renderBody(&bb)
+	var bb bytes.Buffer
+	if err := pageTemplates.ExecuteTemplate(&bb, "main.html", page); err != nil {
+		// The page template itself is broken, so it cannot render the error.
+		logger.Error("template error", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 
-	bb.WriteString("</body>\n")
-	bb.WriteString("</html>\n")
+	// Report the length of the page, but omit the body for HEAD requests.
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Content-Length", strconv.Itoa(bb.Len()))
+	w.WriteHeader(code)
+	if r.Method != http.MethodHead {
+		w.Write(bb.Bytes())
+	}
+}
+
+// negotiateType reports which of the offered media types is most preferred
+// by the Accept header of the request. It reports the first offer if
+// the header is absent or none of the offers are acceptable.
+func negotiateType(r *http.Request, offers ...string) string {
+	best, bestQ := offers[0], -1.0
+	for _, offer := range offers {
+		q := -1.0
+		specificity := -1
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			mediaType, params, err := mime.ParseMediaType(accept)
+			if err != nil {
+				continue
+			}
+			var n int
+			switch {
+			case mediaType == offer:
+				n = 2
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				n = 1
+			case mediaType == "*/*":
+				n = 0
+			default:
+				continue
+			}
+			if n > specificity {
+				specificity = n
+				q = 1.0
+				if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > bestQ && q > 0 {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// allowedMethods is the list of HTTP methods that the server supports.
+var allowedMethods = "GET, HEAD, OPTIONS, PROPFIND"
 
-	w.Write(bb.Bytes())
+// errMethodNotAllowed is reported for unsupported HTTP methods.
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// errListingDisabled is reported for requests to list a directory
+// when directory listings are disabled.
+var errListingDisabled = fmt.Errorf("%w: directory listing disabled", fs.ErrPermission)
+
+// errDenied reports the error for paths matching the deny pattern.
+func errDenied() error {
+	if *denyNotFound {
+		return os.ErrNotExist
+	}
+	return os.ErrPermission
 }
 
+// errTooManyRequests is reported when the server is serving too many requests.
+var errTooManyRequests = errors.New("too many concurrent requests")
+
+// badRequestError is an error that httpError reports as StatusBadRequest.
+type badRequestError string
+
+func (e badRequestError) Error() string { return string(e) }
+
 func httpError(w http.ResponseWriter, r *http.Request, err error) {
-	var code int
+	code := httpStatus(err)
+	if code == http.StatusInternalServerError {
+		logger.Error("request error", "method", r.Method, "path", r.URL.Path, "err", err)
+	}
+	if code == http.StatusNotFound && *denyNotFound {
+		err = fs.ErrNotExist // indistinguishable from denied paths
+	}
+	if negotiateType(r, "text/html", "application/json") == "application/json" {
+		b, _ := json.Marshal(struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+		}{err.Error(), code})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(append(b, '\n'))
+		return
+	}
+	var bb bytes.Buffer
+	if err := pageTemplates.ExecuteTemplate(&bb, "error.html", errorPage{code, http.StatusText(code), err.Error()}); err != nil {
+		logger.Error("template error", "err", err)
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	renderHTML(w, r, code, "", func(w io.Writer) {
+		w.Write(bb.Bytes())
+	})
+}
+
+// httpStatus reports the HTTP status code for an error.
+func httpStatus(err error) int {
 	switch {
-	case os.IsNotExist(err):
-		code = http.StatusNotFound
-	case os.IsPermission(err):
-		code = http.StatusForbidden
+	case errors.As(err, new(badRequestError)):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, errMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.As(err, new(*http.MaxBytesError)):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errTooManyRequests):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errTooManyAttempts):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errFSTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
 	default:
-		code = http.StatusInternalServerError
+		return http.StatusInternalServerError
 	}
-	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-	w.WriteHeader(code)
-	renderHTML(w, r, func(w io.Writer) {
-		io.WriteString(w, http.StatusText(code)+": "+html.EscapeString(err.Error()))
-	})
 }
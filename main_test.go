@@ -0,0 +1,1303 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	var err error
+	if pageTemplates, err = parseTemplates(""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// setValue sets *p to v for the duration of the test.
+// It is used to set flags and other global variables.
+func setValue[T any](t testing.TB, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// writeFiles creates the files within the root directory, mapping each
+// name to its contents. A name with a trailing slash is a directory.
+func writeFiles(t testing.TB, root string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		isDir := strings.HasSuffix(name, "/")
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if isDir {
+			if err := os.MkdirAll(name, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestHandler returns the handler serving the root directory
+// according to the current flags.
+func newTestHandler(t testing.TB, root string) http.Handler {
+	t.Helper()
+	dir, err := openRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFlagsConfig(t, dir)
+	return newHandler(dir)
+}
+
+// useFlagsConfig compiles the pattern flags and reads the redirects file
+// in dir into the current config for the duration of the test.
+func useFlagsConfig(t testing.TB, dir fs.FS) {
+	t.Helper()
+	cfg := new(config)
+	for _, pf := range patternFlags {
+		re, err := compilePattern(flag.Lookup(pf.name).Value.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		*pf.field(cfg) = re
+	}
+	var err error
+	if cfg.redirects, err = readRedirects(dir); err != nil {
+		t.Fatal(err)
+	}
+	old := currentConfig.Load()
+	currentConfig.Store(cfg)
+	t.Cleanup(func() { currentConfig.Store(old) })
+}
+
+// serveRequest serves the request and reports the response and its body.
+func serveRequest(h http.Handler, r *http.Request) (*http.Response, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Result(), rec.Body.String()
+}
+
+// get serves a GET request for the target.
+func get(h http.Handler, target string) (*http.Response, string) {
+	return serveRequest(h, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+// resolveLocation resolves the Location header of the response
+// relative to the target of the request.
+func resolveLocation(t *testing.T, target string, resp *http.Response) string {
+	t.Helper()
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("GET %s: invalid Location: %v", target, err)
+	}
+	base, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base.ResolveReference(loc).String()
+}
+
+// breadcrumbRx matches each link of the breadcrumbs in the page heading.
+var breadcrumbRx = regexp.MustCompile(`<a href="([^"]*)">([^<]*)</a>`)
+
+// breadcrumbs reports the name and resolved URL of each breadcrumb
+// in the HTML page served for the target.
+func breadcrumbs(t *testing.T, target, page string) (names, urls []string) {
+	t.Helper()
+	heading, _, ok := strings.Cut(page, "</h1>")
+	if !ok {
+		t.Fatalf("GET %s: page has no heading", target)
+	}
+	base, _ := url.Parse(target)
+	for _, m := range breadcrumbRx.FindAllStringSubmatch(heading, -1) {
+		u, err := url.Parse(m[1])
+		if err != nil {
+			t.Fatalf("GET %s: invalid breadcrumb URL: %v", target, err)
+		}
+		names = append(names, m[2])
+		urls = append(urls, base.ResolveReference(u).Path)
+	}
+	return names, urls
+}
+
+func TestPrefix(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": "world",
+	})
+	setValue(t, prefix, "/files")
+	h := newTestHandler(t, root)
+
+	// The prefix is stripped from the request path.
+	for target, want := range map[string]string{
+		"/files/a.txt":     "hello",
+		"/files/sub/b.txt": "world",
+	} {
+		resp, body := get(h, target)
+		if resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("GET %s = (%d, %q), want (200, %q)", target, resp.StatusCode, body, want)
+		}
+	}
+
+	// Redirects resolve to paths under the prefix.
+	for target, want := range map[string]string{
+		"/files":        "/files/",
+		"/files/sub":    "/files/sub/",
+		"/files/a.txt/": "/files/a.txt",
+		"/files?x=1":    "/files/?x=1",
+	} {
+		resp, _ := get(h, target)
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("GET %s: status = %d, want 301", target, resp.StatusCode)
+			continue
+		}
+		if got := resolveLocation(t, target, resp); got != want {
+			t.Errorf("GET %s: redirected to %s, want %s", target, got, want)
+		}
+	}
+
+	// Paths outside the prefix do not exist.
+	for _, target := range []string{"/", "/a.txt", "/filesx/a.txt", "/other/files/a.txt"} {
+		if resp, _ := get(h, target); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want 404", target, resp.StatusCode)
+		}
+	}
+
+	// Breadcrumbs link to the root under the prefix and each parent.
+	for target, want := range map[string][]string{
+		"/files/":        {"/files/"},
+		"/files/sub/":    {"/files/", "/files/sub/"},
+		"/files/missing": {"/files/", "/files/missing"},
+	} {
+		_, body := get(h, target)
+		names, urls := breadcrumbs(t, target, body)
+		if strings.Join(urls, " ") != strings.Join(want, " ") {
+			t.Errorf("GET %s: breadcrumb URLs = %q, want %q", target, urls, want)
+		}
+		if len(names) == 0 || names[0] != "/files/" {
+			t.Errorf("GET %s: breadcrumb names = %q, want the root named /files/", target, names)
+		}
+	}
+}
+
+// listing reports the JSON directory listing served for the target.
+func listing(t *testing.T, h http.Handler, target string) (resp *http.Response, entries map[string]fileInfo, total int) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Accept", "application/json")
+	resp, body := serveRequest(h, r)
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil, 0
+	}
+	var v struct {
+		Entries []fileInfo `json:"entries"`
+		Total   int        `json:"total"`
+	}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatalf("GET %s: invalid JSON listing: %v", target, err)
+	}
+	entries = make(map[string]fileInfo)
+	for _, e := range v.Entries {
+		entries[e.Name] = e
+	}
+	return resp, entries, v.Total
+}
+
+func TestBrokenSymlink(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"target.txt": "hello"})
+	if err := os.Symlink("target.txt", filepath.Join(root, "good")); err != nil {
+		t.Skipf("symbolic links unsupported: %v", err)
+	}
+	if err := os.Symlink("missing.txt", filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, root)
+
+	_, entries, _ := listing(t, h, "/")
+	if e, ok := entries["dangling"]; !ok {
+		t.Errorf("dangling symlink is not listed")
+	} else if !e.Broken || e.Size != 0 {
+		t.Errorf("dangling symlink: broken = %v, size = %d, want true and 0", e.Broken, e.Size)
+	}
+	if e, ok := entries["good"]; !ok || e.Broken || e.Size != int64(len("hello")) {
+		t.Errorf("valid symlink: listed = %v, broken = %v, size = %d, want true, false, and 5", ok, e.Broken, e.Size)
+	}
+	if _, body := get(h, "/"); !strings.Contains(body, `dangling</a> <span class="broken">(broken link)</span>`) {
+		t.Errorf("HTML listing does not mark the dangling symlink as broken")
+	}
+	if resp, _ := get(h, "/dangling"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /dangling: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestShowLinks(t *testing.T) {
+	upper, lower := t.TempDir(), t.TempDir()
+	writeFiles(t, upper, map[string]string{"sub/a.txt": "upper"})
+	writeFiles(t, lower, map[string]string{"sub/b.txt": "lower"})
+	for name, target := range map[string]string{
+		"sub/inside":   "b.txt",
+		"sub/parent":   "../sub",
+		"sub/outside":  "../../etc/passwd",
+		"sub/absolute": "/etc/passwd",
+	} {
+		if err := os.Symlink(target, filepath.Join(lower, filepath.FromSlash(name))); err != nil {
+			t.Skipf("symbolic links unsupported: %v", err)
+		}
+	}
+	setValue(t, links, true)
+
+	// Links in a lower layer are read through the layers,
+	// which are wrapped by the file system timeout.
+	dir, err := openRoot(upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := openRoot(lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := timeoutFS{overlayFS{dir, layer}, time.Minute}
+	useFlagsConfig(t, fsys)
+	_, entries, _ := listing(t, newHandler(fsys), "/sub/")
+	for name, want := range map[string]struct {
+		link    string
+		escapes bool
+	}{
+		"inside":   {"b.txt", false},
+		"parent/":  {"../sub", false},
+		"outside":  {"../../etc/passwd", true},
+		"absolute": {"/etc/passwd", true},
+		"a.txt":    {"", false},
+	} {
+		if e := entries[name]; e.Link != want.link || e.Escapes != want.escapes {
+			t.Errorf("%s: link = (%q, %v), want (%q, %v)", name, e.Link, e.Escapes, want.link, want.escapes)
+		}
+	}
+
+	// A whiteout in the upper layer hides the link in the lower layer.
+	writeFiles(t, upper, map[string]string{"sub/.wh.inside": ""})
+	if _, err := fsys.ReadLink("sub/inside"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadLink of a whited out link: error = %v, want fs.ErrNotExist", err)
+	}
+
+	// Archives cannot read links.
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "target"})
+	tw.Close()
+	tfs, err := newTarFS(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, escapes := readLink(tfs, "link"); target != "" || escapes {
+		t.Errorf("readLink in a tar file = (%q, %v), want no target", target, escapes)
+	}
+}
+
+// panicFS is a file system whose Open panics with the value.
+type panicFS struct{ v any }
+
+func (fsys panicFS) Open(name string) (fs.File, error) { panic(fsys.v) }
+
+func TestPanic(t *testing.T) {
+	var logs bytes.Buffer
+	setValue(t, &logger, slog.New(slog.NewTextHandler(&logs, nil)))
+	useFlagsConfig(t, fstest.MapFS{})
+
+	// A panic is logged and reported to the client as an error.
+	resp, _ := get(newHandler(panicFS{"boom"}), "/a.txt")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", resp.StatusCode)
+	}
+	if got := logs.String(); !strings.Contains(got, "panic serving request") || !strings.Contains(got, "boom") || !strings.Contains(got, "path=/a.txt") {
+		t.Errorf("panic not logged with the request path and value:\n%s", got)
+	}
+
+	// A panic with http.ErrAbortHandler is propagated to abort the response.
+	func() {
+		defer func() {
+			if ex := recover(); ex != http.ErrAbortHandler {
+				t.Errorf("recovered %v, want http.ErrAbortHandler", ex)
+			}
+		}()
+		get(newHandler(panicFS{http.ErrAbortHandler}), "/a.txt")
+	}()
+}
+
+// readerFromRecorder is an httptest.ResponseRecorder that records
+// whether its ReadFrom method was called.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	called bool
+}
+
+func (rec *readerFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	rec.called = true
+	return io.Copy(rec.ResponseRecorder, r)
+}
+
+func TestCopyBuffer(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "a.txt")
+	writeFiles(t, filepath.Dir(name), map[string]string{"a.txt": "hello"})
+	for _, tt := range []struct {
+		plaintext bool
+		reader    func(*os.File) io.Reader
+		want      bool
+	}{
+		{true, func(f *os.File) io.Reader { return f }, true},
+		{true, func(f *os.File) io.Reader { return io.LimitReader(f, 3) }, true},
+		{true, func(f *os.File) io.Reader { return struct{ io.Reader }{f} }, false},
+		{false, func(f *os.File) io.Reader { return f }, false},
+	} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		rec := &responseRecorder{ResponseWriter: w, plaintext: tt.plaintext}
+		r := tt.reader(f)
+		n, err := rec.ReadFrom(r)
+		f.Close()
+		if err != nil || n != int64(w.Body.Len()) || rec.bytes != n {
+			t.Errorf("ReadFrom(%T) = (%d, %v), wrote %d bytes, recorded %d bytes", r, n, err, w.Body.Len(), rec.bytes)
+		}
+		if w.called != tt.want {
+			t.Errorf("ReadFrom(%T) with plaintext %v: used sendfile = %v, want %v", r, tt.plaintext, w.called, tt.want)
+		}
+	}
+}
+
+func BenchmarkDownload(b *testing.B) {
+	const size = 64 << 20
+	root := b.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "large.bin"), bytes.Repeat([]byte("0123456789abcdef"), size/16), 0644); err != nil {
+		b.Fatal(err)
+	}
+	dir, err := openRoot(root)
+	if err != nil {
+		b.Fatal(err)
+	}
+	old := currentConfig.Load()
+	currentConfig.Store(new(config))
+	defer currentConfig.Store(old)
+
+	download := func(b *testing.B, srv *httptest.Server) {
+		b.SetBytes(size)
+		for range b.N {
+			resp, err := srv.Client().Get(srv.URL + "/large.bin")
+			if err != nil {
+				b.Fatal(err)
+			}
+			n, err := io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if err != nil || n != size {
+				b.Fatalf("downloaded %d bytes: %v", n, err)
+			}
+		}
+	}
+
+	// Plaintext connections use the sendfile syscall.
+	b.Run("Plaintext", func(b *testing.B) {
+		srv := httptest.NewServer(newHandler(dir))
+		defer srv.Close()
+		download(b, srv)
+	})
+
+	// TLS connections copy using the buffer.
+	srv := httptest.NewTLSServer(newHandler(dir))
+	defer srv.Close()
+	for _, bufSize := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("TLS/Buffer=%dK", bufSize>>10), func(b *testing.B) {
+			setValue(b, copyBufSize, bufSize)
+			download(b, srv)
+		})
+	}
+}
+
+func FuzzRequestPath(f *testing.F) {
+	const secret = "secret outside the root"
+	parent := f.TempDir()
+	writeFiles(f, parent, map[string]string{
+		"secret.txt":      secret,
+		"root/public.txt": "public",
+		"root/sub/a.txt":  "a",
+	})
+	h := newTestHandler(f, filepath.Join(parent, "root"))
+
+	for _, target := range []string{
+		"/public.txt",
+		"/../secret.txt",
+		"/../../etc/passwd",
+		"/sub/../../secret.txt",
+		"/%2e%2e/secret.txt",
+		"/%2E%2E%2Fsecret.txt",
+		"/sub/%2e%2e%2f%2e%2e%2fsecret.txt",
+		"/..%5csecret.txt",
+		`/sub\..\..\secret.txt`,
+		"/sub/..%5c..%5csecret.txt",
+		"/public.txt%00.jpg",
+		"/%00/../secret.txt",
+		"//..//secret.txt",
+		"/./.././secret.txt",
+		"http://host/../secret.txt",
+		"*",
+	} {
+		f.Add(target)
+	}
+	f.Fuzz(func(t *testing.T, target string) {
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n")))
+		if err != nil {
+			t.Skip()
+		}
+		r.RemoteAddr = "192.0.2.1:1234"
+		resp, body := serveRequest(h, r)
+		if strings.Contains(body, secret) {
+			t.Fatalf("GET %s: status %d: served a file outside the root", target, resp.StatusCode)
+		}
+	})
+}
+
+func TestControlCharacters(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"foobar": "hello"})
+	h := newTestHandler(t, root)
+	for _, target := range []string{"/foo%00bar", "/foo%0abar", "/foo%0dbar", "/foo%1fbar", "/foo%7fbar", "/foo%09bar", "/%00/foobar"} {
+		if resp, _ := get(h, target); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s: status = %d, want 400", target, resp.StatusCode)
+		}
+	}
+	if resp, body := get(h, "/foobar"); resp.StatusCode != http.StatusOK || body != "hello" {
+		t.Errorf("GET /foobar = (%d, %q), want (200, %q)", resp.StatusCode, body, "hello")
+	}
+}
+
+func TestHead(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello", "sub/b.txt": "world"})
+	h := newTestHandler(t, root)
+	for _, target := range []string{"/", "/sub/", "/a.txt", "/missing"} {
+		getResp, getBody := get(h, target)
+		headResp, headBody := serveRequest(h, httptest.NewRequest(http.MethodHead, target, nil))
+		if headResp.StatusCode != getResp.StatusCode {
+			t.Errorf("HEAD %s: status = %d, want %d", target, headResp.StatusCode, getResp.StatusCode)
+		}
+		if headBody != "" {
+			t.Errorf("HEAD %s: body = %q, want empty", target, headBody)
+		}
+		if got, want := headResp.Header.Get("Content-Length"), strconv.Itoa(len(getBody)); got != want {
+			t.Errorf("HEAD %s: Content-Length = %s, want %s", target, got, want)
+		}
+		if got, want := headResp.Header.Get("Content-Type"), getResp.Header.Get("Content-Type"); got != want {
+			t.Errorf("HEAD %s: Content-Type = %s, want %s", target, got, want)
+		}
+	}
+}
+
+func TestSingleFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "root file", "x/y": "root file"})
+	page := filepath.Join(t.TempDir(), "page.html")
+	writeFiles(t, filepath.Dir(page), map[string]string{"page.html": "<p>maintenance</p>"})
+	setValue(t, singleFile, page)
+	h := newTestHandler(t, root)
+
+	// Every path serves the file with the Content-Type of its own name.
+	const wantType = "text/html; charset=utf-8"
+	for _, target := range []string{"/", "/x/y", "/x/", "/a.txt", "/missing.json", "/.stat"} {
+		resp, body := get(h, target)
+		if resp.StatusCode != http.StatusOK || body != "<p>maintenance</p>" {
+			t.Errorf("GET %s = (%d, %q), want (200, the file)", target, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Content-Type"); got != wantType {
+			t.Errorf("GET %s: Content-Type = %s, want %s", target, got, wantType)
+		}
+
+		resp, body = serveRequest(h, httptest.NewRequest(http.MethodHead, target, nil))
+		if resp.StatusCode != http.StatusOK || body != "" {
+			t.Errorf("HEAD %s = (%d, %q), want (200, empty)", target, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Content-Type"); got != wantType {
+			t.Errorf("HEAD %s: Content-Type = %s, want %s", target, got, wantType)
+		}
+		if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(len("<p>maintenance</p>")); got != want {
+			t.Errorf("HEAD %s: Content-Length = %s, want %s", target, got, want)
+		}
+	}
+}
+
+func TestStaticAssetETag(t *testing.T) {
+	root := t.TempDir()
+	setValue(t, &robotsAsset, newStaticAsset("robots.txt", []byte("User-agent: *\nDisallow: /\n"), "public, max-age=86400"))
+	h := newTestHandler(t, root)
+
+	for _, a := range []*staticAsset{faviconAsset, robotsAsset} {
+		target := "/" + a.name
+		resp, body := get(h, target)
+		if resp.StatusCode != http.StatusOK || body != string(a.data) {
+			t.Fatalf("GET %s = (%d, %d bytes), want (200, %d bytes)", target, resp.StatusCode, len(body), len(a.data))
+		}
+		etag := resp.Header.Get("ETag")
+		if etag != a.etag || !strings.HasPrefix(etag, `"`) {
+			t.Errorf("GET %s: ETag = %s, want strong validator %s", target, etag, a.etag)
+		}
+		if got := resp.Header.Get("Cache-Control"); got != a.cacheControl {
+			t.Errorf("GET %s: Cache-Control = %s, want %s", target, got, a.cacheControl)
+		}
+
+		for _, tt := range []struct {
+			ifNoneMatch string
+			status      int
+		}{
+			{etag, http.StatusNotModified},
+			{"*", http.StatusNotModified},
+			{"W/" + etag, http.StatusNotModified}, // weak comparison
+			{`"other", ` + etag, http.StatusNotModified},
+			{`"other"`, http.StatusOK},
+			{`W/"other"`, http.StatusOK},
+		} {
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				r := httptest.NewRequest(method, target, nil)
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+				resp, body := serveRequest(h, r)
+				if resp.StatusCode != tt.status {
+					t.Errorf("%s %s with If-None-Match %s: status = %d, want %d", method, target, tt.ifNoneMatch, resp.StatusCode, tt.status)
+				}
+				if resp.StatusCode == http.StatusNotModified && (body != "" || resp.Header.Get("ETag") != etag) {
+					t.Errorf("%s %s with If-None-Match %s: got (%q, ETag %s), want (empty, ETag %s)", method, target, tt.ifNoneMatch, body, resp.Header.Get("ETag"), etag)
+				}
+			}
+		}
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello", "sub/b.txt": "world"})
+	h := newTestHandler(t, root)
+
+	for _, tt := range []struct {
+		target string
+		accept string
+		status int
+		json   bool
+	}{
+		{"/missing", "", 404, false},
+		{"/missing", "text/html", 404, false},
+		{"/missing", "application/json", 404, true},
+		{"/missing", "text/html;q=0.5, application/json", 404, true},
+		{"/.api/missing", "", 404, true},
+		{"/.api/missing", "text/html", 404, true},
+		{"/.api/sub/", "", 200, true},
+		{"/.api/a.txt", "", 200, false}, // file contents are served as is
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		resp, body := serveRequest(h, r)
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s with Accept %q: status = %d, want %d", tt.target, tt.accept, resp.StatusCode, tt.status)
+		}
+		if isJSON := resp.Header.Get("Content-Type") == "application/json"; isJSON != tt.json {
+			t.Errorf("GET %s with Accept %q: Content-Type = %s, want JSON %v", tt.target, tt.accept, resp.Header.Get("Content-Type"), tt.json)
+			continue
+		}
+		if tt.json && tt.status != http.StatusOK {
+			var v struct {
+				Error  string `json:"error"`
+				Status int    `json:"status"`
+			}
+			if err := json.Unmarshal([]byte(body), &v); err != nil || v.Error == "" || v.Status != tt.status {
+				t.Errorf("GET %s with Accept %q: body = %s, want a JSON error with status %d", tt.target, tt.accept, body, tt.status)
+			}
+		}
+	}
+
+	// The API prefix itself redirects to the root directory.
+	resp, _ := get(h, "/.api")
+	if got := resolveLocation(t, "/.api", resp); resp.StatusCode != http.StatusMovedPermanently || got != "/.api/" {
+		t.Errorf("GET /.api = (%d, %s), want (301, /.api/)", resp.StatusCode, got)
+	}
+}
+
+func TestNameFilterPathological(t *testing.T) {
+	name := strings.Repeat("a", 64<<10)
+	for _, tt := range []struct{ pattern, mode string }{
+		{"(a*)*b", "regex"},
+		{"(a+a+)+b", "regex"},
+		{"(a|aa)*b", "regex"},
+		{"*a*a*a*a*a*b", "glob"},
+	} {
+		match, err := newNameFilter(tt.pattern, tt.mode, true)
+		if err != nil {
+			t.Fatalf("newNameFilter(%q, %q): %v", tt.pattern, tt.mode, err)
+		}
+		start := time.Now()
+		if match(name) {
+			t.Errorf("filter %q matched %d a's", tt.pattern, len(name))
+		}
+		// A backtracking matcher would take longer than the age of the universe.
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("filter %q took %v to match %d a's", tt.pattern, d, len(name))
+		}
+	}
+
+	// Regular expressions are limited in length.
+	if _, err := newNameFilter(strings.Repeat("a", 256), "regex", false); err != nil {
+		t.Errorf("newNameFilter with a 256-byte regular expression: %v", err)
+	}
+	if _, err := newNameFilter(strings.Repeat("a", 257), "regex", false); httpStatus(err) != http.StatusBadRequest {
+		t.Errorf("newNameFilter with a 257-byte regular expression: error = %v, want a bad request", err)
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// checkGolden compares got with the named golden file in testdata,
+// or updates the golden file if the -update flag is set.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	name = filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (run with -update to update it):\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for _, tt := range []struct {
+		units string
+		in    int64
+		want  string
+	}{
+		{"iec", 0, "0B"},
+		{"iec", 999, "999B"},
+		{"iec", 1000, "1000B"},
+		{"iec", 1023, "1023B"},
+		{"iec", 1024, "1.0KiB"},
+		{"iec", 1536, "1.5KiB"},
+		{"iec", 1<<20 - 1, "1.0MiB"},
+		{"iec", 1 << 20, "1.0MiB"},
+		{"iec", 3 << 29, "1.5GiB"},
+		{"iec", 123456789012, "115.0GiB"},
+		{"iec", 1 << 50, "1.0PiB"},
+		{"iec", math.MaxInt64, "8.0EiB"},
+		{"si", 0, "0B"},
+		{"si", 999, "999B"},
+		{"si", 1000, "1.0kB"},
+		{"si", 1023, "1.0kB"},
+		{"si", 1024, "1.0kB"},
+		{"si", 999_949, "999.9kB"},
+		{"si", 999_999, "1.0MB"},
+		{"si", 1_000_000, "1.0MB"},
+		{"si", 123456789012, "123.5GB"},
+		{"si", math.MaxInt64, "9.2EB"},
+	} {
+		setValue(t, sizeUnits, tt.units)
+		if got := formatSize(tt.in); got != tt.want {
+			t.Errorf("formatSize(%d) with -size-units=%s = %q, want %q", tt.in, tt.units, got, tt.want)
+		}
+	}
+}
+
+func TestFormatLong(t *testing.T) {
+	modTime := time.Date(2021, 3, 14, 15, 9, 26, 0, time.FixedZone("PDT", -7*60*60))
+	fis := []fileInfo{
+		{Name: "sub/", Mode: fs.ModeDir | 0755, ModTime: modTime},
+		{Name: "a.txt", Mode: 0644, Size: 5, ModTime: modTime.Add(-24 * time.Hour)},
+		{Name: "a very long name with spaces.tar.gz", Mode: 0600, Size: 123456789012, ModTime: modTime.AddDate(-3, 0, 0)},
+		{Name: "link", Mode: fs.ModeSymlink | 0777, ModTime: modTime, Link: "../outside", Escapes: true},
+		{Name: "日本語.txt", Mode: 0444, Size: 0, ModTime: time.Unix(0, 0)},
+	}
+	checkGolden(t, "long.golden", formatLong(fis))
+
+	// Owners and link counts are aligned in their own columns.
+	for i := range fis {
+		fis[i].User, fis[i].Group = "root", "wheel"
+		fis[i].LinkCount = 1
+	}
+	fis[0].User, fis[0].Group, fis[0].LinkCount = "a-long-user-name", "staff", 12
+	fis[2].User, fis[2].Group = "1001", "a-long-group-name"
+	checkGolden(t, "long_owner.golden", formatLong(fis))
+}
+
+func TestPagesGolden(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt":             "hello",
+		"sub/b & <c>.html":  "<p>hello</p>",
+		"sub/deeper/d.json": "{}",
+	})
+	for name, modTime := range map[string]time.Time{
+		"a.txt":             time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC),
+		"sub/b & <c>.html":  time.Date(2021, 5, 6, 12, 0, 0, 0, time.UTC),
+		"sub/deeper/d.json": time.Date(2019, 12, 31, 12, 0, 0, 0, time.UTC),
+	} {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setValue(t, &time.Local, time.UTC)
+	h := newTestHandler(t, root)
+
+	for _, tt := range []struct {
+		target string
+		status int
+		golden string
+	}{
+		{"/missing.txt", http.StatusNotFound, "error.golden"},
+		{"/sub/%3Cscript%3E&.txt", http.StatusNotFound, "error_escaped.golden"},
+		{"/?recent=10", http.StatusOK, "recent.golden"},
+		{"/sub/?recent=1", http.StatusOK, "recent_sub.golden"},
+	} {
+		resp, body := get(h, tt.target)
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s: status = %d, want %d", tt.target, resp.StatusCode, tt.status)
+		}
+		checkGolden(t, tt.golden, []byte(body))
+	}
+}
+
+// TestHiddenAndDenied checks the interaction of the hide, deny,
+// and allow-direct patterns documented in the README, where the name
+// of each file lists the patterns it matches.
+func TestHiddenAndDenied(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"sub/x": "", "sub/h": "", "sub/ha": "", "sub/d": "", "sub/da": "", "sub/hd": "", "sub/hda": "",
+	})
+	setValue(t, hide, "^/sub/[^/]*h[^/]*$")
+	setValue(t, deny, "^/sub/[^/]*d[^/]*$")
+	setValue(t, allowDirect, "^/sub/[^/]*a[^/]*$")
+	h := newTestHandler(t, root)
+
+	tests := []struct {
+		name   string
+		listed bool
+		direct int // status of a direct request
+		strict int // status of a direct request with -hide-strict
+	}{
+		{"x", true, 200, 200},
+		{"h", false, 200, 404},
+		{"ha", false, 200, 200},
+		{"d", false, 403, 403},
+		{"da", false, 403, 403},
+		{"hd", false, 403, 404},
+		{"hda", false, 403, 403},
+	}
+	_, entries, _ := listing(t, h, "/sub/")
+	for _, tt := range tests {
+		if _, ok := entries[tt.name]; ok != tt.listed {
+			t.Errorf("%s: listed = %v, want %v", tt.name, ok, tt.listed)
+		}
+		if resp, _ := get(h, "/sub/"+tt.name); resp.StatusCode != tt.direct {
+			t.Errorf("GET /sub/%s: status = %d, want %d", tt.name, resp.StatusCode, tt.direct)
+		}
+	}
+
+	// Requests to /.stat report paths as direct requests with -hide-strict.
+	setValue(t, hideStrict, true)
+	var paths []string
+	for _, tt := range tests {
+		paths = append(paths, "/sub/"+tt.name)
+	}
+	results := statPaths(t, h, paths...)
+	for i, tt := range tests {
+		if resp, _ := get(h, "/sub/"+tt.name); resp.StatusCode != tt.strict {
+			t.Errorf("GET /sub/%s with -hide-strict: status = %d, want %d", tt.name, resp.StatusCode, tt.strict)
+		}
+		status := results[i].Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status != tt.strict {
+			t.Errorf("POST %s for /sub/%s: status = %d, want %d", statPath, tt.name, status, tt.strict)
+		}
+	}
+}
+
+func TestDenyAsNotFound(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"secret.txt": "hello", "secrets/a.txt": "world"})
+	setValue(t, deny, "^/secret")
+	h := newTestHandler(t, root)
+
+	// serve serves a request for the target and reports the status
+	// and the error message of the JSON response.
+	serve := func(method, target string) (int, string) {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Accept", "application/json")
+		resp, body := serveRequest(h, r)
+		var v struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal([]byte(body), &v)
+		return resp.StatusCode, v.Error
+	}
+
+	for _, notFound := range []bool{false, true} {
+		setValue(t, denyNotFound, notFound)
+		wantStatus := http.StatusForbidden
+		if notFound {
+			wantStatus = http.StatusNotFound
+		}
+		_, missingErr := serve(http.MethodGet, "/missing.txt")
+		if missingErr == "" {
+			t.Fatalf("GET /missing.txt: no JSON error")
+		}
+		for _, target := range []string{"/secret.txt", "/secrets/", "/secrets", "/secrets/a.txt"} {
+			for _, method := range []string{http.MethodGet, methodPropfind} {
+				status, msg := serve(method, target)
+				if status != wantStatus {
+					t.Errorf("%s %s with -deny-as-notfound=%v: status = %d, want %d", method, target, notFound, status, wantStatus)
+				}
+				if notFound && msg != missingErr {
+					t.Errorf("%s %s with -deny-as-notfound: error = %q, want %q as for a missing path", method, target, msg, missingErr)
+				}
+			}
+		}
+
+		results := statPaths(t, h, "/secret.txt", "/secrets", "/secrets/a.txt", "/missing.txt")
+		for _, res := range results[:3] {
+			if res.Status != wantStatus {
+				t.Errorf("POST %s for %s with -deny-as-notfound=%v: status = %d, want %d", statPath, res.Path, notFound, res.Status, wantStatus)
+			}
+			if notFound && res.Error != results[3].Error {
+				t.Errorf("POST %s for %s with -deny-as-notfound: error = %q, want %q as for a missing path", statPath, res.Path, res.Error, results[3].Error)
+			}
+		}
+	}
+}
+
+func TestMaxListEntries(t *testing.T) {
+	const max = 3
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"two/a": "", "two/b": "",
+		"three/a": "", "three/b": "", "three/c": "",
+		"four/a": "", "four/b": "", "four/c": "", "four/d": "",
+	})
+	setValue(t, maxListEntries, max)
+	h := newTestHandler(t, root)
+
+	// list serves a JSON listing for the target.
+	type result struct {
+		Entries   []fileInfo `json:"entries"`
+		Total     int        `json:"total"`
+		Truncated bool       `json:"truncated"`
+		Next      string     `json:"next"`
+	}
+	list := func(target string) (v result) {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Accept", "application/json")
+		resp, body := serveRequest(h, r)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, want 200", target, resp.StatusCode)
+		}
+		if err := json.Unmarshal([]byte(body), &v); err != nil {
+			t.Fatalf("GET %s: invalid JSON listing: %v", target, err)
+		}
+		return v
+	}
+
+	for _, tt := range []struct {
+		dir       string
+		total     int
+		truncated bool
+	}{
+		{"/two/", max - 1, false},
+		{"/three/", max, false},
+		{"/four/", max + 1, true},
+	} {
+		v := list(tt.dir)
+		if v.Total != tt.total {
+			t.Errorf("GET %s: total = %d, want %d", tt.dir, v.Total, tt.total)
+		}
+		if got, want := len(v.Entries), min(tt.total, max); got != want {
+			t.Errorf("GET %s: %d entries, want %d", tt.dir, got, want)
+		}
+		if v.Truncated != tt.truncated || (v.Next != "") != tt.truncated {
+			t.Errorf("GET %s: truncated = %v, next = %q, want truncated %v", tt.dir, v.Truncated, v.Next, tt.truncated)
+		}
+
+		// Other formats are truncated the same way, and report the next page
+		// in the Link header, which HTML listings also link to.
+		for _, format := range []string{"html", "text", "long"} {
+			target := tt.dir + "?format=" + format
+			resp, body := get(h, target)
+			var wantLink string
+			if tt.truncated {
+				wantLink = "<" + strings.Replace(v.Next, "offset=", "format="+format+"&offset=", 1) + `>; rel="next"`
+			}
+			if got := resp.Header.Get("Link"); got != wantLink {
+				t.Errorf("GET %s: Link = %q, want %q", target, got, wantLink)
+			}
+			switch format {
+			case "html":
+				if got := strings.Contains(body, "Show more</a>"); got != tt.truncated {
+					t.Errorf("GET %s: links to more entries = %v, want %v", target, got, tt.truncated)
+				}
+				if got, want := len(regexp.MustCompile(`<a href="[a-d]">`).FindAllString(body, -1)), min(tt.total, max); got != want {
+					t.Errorf("GET %s: %d entries, want %d", target, got, want)
+				}
+			case "text", "long":
+				if got, want := strings.Count(body, "\n"), min(tt.total, max); got != want {
+					t.Errorf("GET %s: %d lines, want %d", target, got, want)
+				}
+			}
+		}
+		if !tt.truncated {
+			continue
+		}
+
+		// The next page has the remaining entries and is not truncated.
+		if !strings.HasPrefix(v.Next, "?offset=") {
+			t.Fatalf("GET %s: next = %q, want a query with an offset", tt.dir, v.Next)
+		}
+		next := tt.dir + v.Next
+		v2 := list(next)
+		if v2.Total != tt.total || v2.Truncated || v2.Next != "" {
+			t.Errorf("GET %s: total = %d, truncated = %v, next = %q, want %d, false, and none", next, v2.Total, v2.Truncated, v2.Next, tt.total)
+		}
+		if len(v2.Entries) != tt.total-max || len(v2.Entries) > 0 && v2.Entries[0].Name != "d" {
+			t.Errorf("GET %s: entries = %v, want only d", next, v2.Entries)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello", "sub/b.txt": "world"})
+	h := newTestHandler(t, root)
+
+	if resp, _ := get(h, "/sub/"); resp.Header.Get("Server-Timing") != "" {
+		t.Errorf("GET /sub/ without -server-timing: Server-Timing = %q, want none", resp.Header.Get("Server-Timing"))
+	}
+
+	setValue(t, serverTiming, true)
+	metricRx := regexp.MustCompile(`^([a-z]+);dur=[0-9]+[.][0-9]{3}$`)
+	for _, tt := range []struct {
+		method string
+		target string
+		want   []string // names of the metrics, in order
+	}{
+		{http.MethodGet, "/a.txt", []string{"resolve", "serve"}},
+		{http.MethodHead, "/a.txt", []string{"resolve", "serve"}},
+		{http.MethodGet, "/sub/", []string{"resolve", "readdir", "serve"}},
+		{http.MethodHead, "/sub/", []string{"resolve", "readdir", "serve"}},
+		{http.MethodGet, "/missing.txt", []string{"serve"}},
+	} {
+		resp, _ := serveRequest(h, httptest.NewRequest(tt.method, tt.target, nil))
+		header := resp.Header.Get("Server-Timing")
+		var names []string
+		for _, metric := range strings.Split(header, ", ") {
+			m := metricRx.FindStringSubmatch(metric)
+			if m == nil {
+				t.Errorf("%s %s: invalid Server-Timing metric %q", tt.method, tt.target, metric)
+				continue
+			}
+			names = append(names, m[1])
+		}
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s %s: Server-Timing = %q, want metrics %v", tt.method, tt.target, header, tt.want)
+		}
+	}
+}
+
+func TestIndexNames(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"all/index.htm": "htm", "all/index.html": "html", "all/index.md": "md", "all/other.txt": "other",
+		"some/index.htm": "htm", "some/index.md": "md",
+		"none/other.txt": "other",
+	})
+	setValue(t, &indexFiles, []string{"index.html", "index.htm", "index.md"})
+	h := newTestHandler(t, root)
+
+	// The index file with the highest priority is served,
+	// independent of the order of the directory entries.
+	for target, want := range map[string]string{"/all/": "html", "/some/": "htm"} {
+		if resp, body := get(h, target); resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("GET %s = (%d, %q), want (200, %q)", target, resp.StatusCode, body, want)
+		}
+	}
+	if resp, body := get(h, "/none/"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "other.txt") {
+		t.Errorf("GET /none/ = (%d, %q), want a listing", resp.StatusCode, body)
+	}
+
+	// Direct requests for any index file redirect to the directory.
+	for _, target := range []string{"/all/index.html", "/all/index.htm", "/all/index.md", "/some/index.md"} {
+		resp, _ := get(h, target)
+		if got, want := resolveLocation(t, target, resp), path.Dir(target)+"/"; resp.StatusCode != http.StatusMovedPermanently || got != want {
+			t.Errorf("GET %s = (%d, %s), want (301, %s)", target, resp.StatusCode, got, want)
+		}
+	}
+	if resp, body := get(h, "/all/other.txt"); resp.StatusCode != http.StatusOK || body != "other" {
+		t.Errorf("GET /all/other.txt = (%d, %q), want (200, %q)", resp.StatusCode, body, "other")
+	}
+}
+
+func TestListingFormats(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello", "b.txt": "world", "sub/": ""})
+	h := newTestHandler(t, root)
+
+	for _, tt := range []struct {
+		query       string
+		accept      string
+		contentType string
+		check       func(body string) bool
+	}{
+		{"", "", "text/html; charset=UTF-8", isHTMLListing},
+		{"", "text/html", "text/html; charset=UTF-8", isHTMLListing},
+		{"", "application/json", "application/json", isJSONListing},
+		{"", "text/plain", "text/plain; charset=utf-8", isTextListing},
+		{"", "text/plain;q=0.5, application/json", "application/json", isJSONListing},
+		{"?format=html", "application/json", "text/html; charset=UTF-8", isHTMLListing},
+		{"?format=json", "", "application/json", isJSONListing},
+		{"?format=text", "text/html", "text/plain; charset=utf-8", isTextListing},
+		{"?format=long", "", "text/plain; charset=utf-8", isLongListing},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/"+tt.query, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		resp, body := serveRequest(h, r)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != tt.contentType {
+			t.Errorf("GET /%s with Accept %q = (%d, %s), want (200, %s)", tt.query, tt.accept, resp.StatusCode, resp.Header.Get("Content-Type"), tt.contentType)
+			continue
+		}
+		if !tt.check(body) {
+			t.Errorf("GET /%s with Accept %q: unexpected body:\n%s", tt.query, tt.accept, body)
+		}
+	}
+	if resp, _ := get(h, "/?format=xml"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /?format=xml: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+// isHTMLListing reports whether the body is an HTML listing of a.txt, b.txt, and sub/.
+func isHTMLListing(body string) bool {
+	return strings.Contains(body, "<html") && strings.Contains(body, `href="a.txt"`) &&
+		strings.Contains(body, `href="b.txt"`) && strings.Contains(body, `href="sub/"`)
+}
+
+// isJSONListing reports whether the body is a JSON listing of a.txt, b.txt, and sub/.
+func isJSONListing(body string) bool {
+	var v struct {
+		Entries []fileInfo `json:"entries"`
+	}
+	if json.Unmarshal([]byte(body), &v) != nil {
+		return false
+	}
+	var names []string
+	for _, e := range v.Entries {
+		names = append(names, e.Name)
+	}
+	return strings.Join(names, " ") == "a.txt b.txt sub/"
+}
+
+// isTextListing reports whether the body is a text listing of a.txt, b.txt, and sub/.
+func isTextListing(body string) bool {
+	return body == "a.txt\nb.txt\nsub/\n"
+}
+
+// isLongListing reports whether the body is a long listing of a.txt, b.txt, and sub/.
+func isLongListing(body string) bool {
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	return len(lines) == 3 && strings.HasSuffix(lines[0], " a.txt") && strings.HasSuffix(lines[1], " b.txt") &&
+		strings.HasPrefix(lines[2], "d") && strings.HasSuffix(lines[2], " sub/")
+}
+
+func TestFilterMatched(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"f0": "", "f1": "", "f2": "", "f3": "", "f4": "", "g0": ""})
+	setValue(t, maxListEntries, 2)
+	h := newTestHandler(t, root)
+
+	for _, tt := range []struct {
+		query   string
+		entries int
+		matched int
+	}{
+		{"", 2, 6},
+		{"?filter=f[0-3]", 2, 4},
+		{"?filter=f[0-3]&offset=3", 1, 4},
+		{"?filter=g*", 1, 1},
+		{"?filter=h*", 0, 0},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/"+tt.query, nil)
+		r.Header.Set("Accept", "application/json")
+		_, body := serveRequest(h, r)
+		var v struct {
+			Entries []fileInfo `json:"entries"`
+			Total   int        `json:"total"`
+			Matched int        `json:"matched"`
+		}
+		if err := json.Unmarshal([]byte(body), &v); err != nil {
+			t.Fatalf("GET /%s: invalid JSON listing: %v", tt.query, err)
+		}
+		if !strings.Contains(body, `"matched":`) {
+			t.Errorf("GET /%s: no matched field", tt.query)
+		}
+		if len(v.Entries) != tt.entries || v.Matched != tt.matched || v.Total != 6 {
+			t.Errorf("GET /%s: %d entries, matched = %d, total = %d, want %d, %d, and 6", tt.query, len(v.Entries), v.Matched, v.Total, tt.entries, tt.matched)
+		}
+	}
+}
+
+func TestCompareNatural(t *testing.T) {
+	for _, tt := range []struct {
+		x, y string
+		want int
+	}{
+		{"", "", 0},
+		{"a", "a", 0},
+		{"file2", "file10", -1},
+		{"file10", "file2", +1},
+		{"file10", "file10", 0},
+		{"2", "10", -1},
+		{"file", "file1", -1}, // a prefix sorts first
+		{"a 2", "a10", -1},    // a space sorts before a digit
+		{"日本2", "日本10", -1},
+
+		// Numbers are compared by value, regardless of their length.
+		{"file01", "file2", -1},
+		{"file010", "file9", +1},
+		{"v1.10.0", "v1.9.3", +1},
+		{"a1b2", "a1b10", -1},
+		{"x99999999999999999999", "x100000000000000000000", -1},
+
+		// Numbers equal in value are ordered lexically,
+		// but only if the rest of the names are equal.
+		{"file01", "file1", -1},
+		{"file001", "file01", -1},
+		{"a01b", "a1c", -1},
+
+		// Case is not folded, similar to strings.Compare.
+		{"File2", "file1", -1},
+		{"file2", "File10", +1},
+		{"B", "a", -1},
+	} {
+		if got := compareNatural(tt.x, tt.y); got != tt.want {
+			t.Errorf("compareNatural(%q, %q) = %d, want %d", tt.x, tt.y, got, tt.want)
+		}
+		if got := compareNatural(tt.y, tt.x); got != -tt.want {
+			t.Errorf("compareNatural(%q, %q) = %d, want %d", tt.y, tt.x, got, -tt.want)
+		}
+	}
+}
+
+func TestSortListing(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"B/":         "",
+		"a10/":       "",
+		"a9/":        "",
+		"File3.txt":  "four",
+		"file1.txt":  "333",
+		"file2.txt":  "22",
+		"file10.txt": "1",
+	})
+	// Set the modification times such that the date order differs
+	// from both the name and size orders.
+	base := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	for i, name := range []string{"file2.txt", "a9", "File3.txt", "file10.txt", "B", "file1.txt", "a10"} {
+		ts := base.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(filepath.Join(root, name), ts, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		flags map[*bool]bool
+		query string
+		want  string // space-separated names, or the status code
+	}{
+		{nil, "sort=name", "B/ File3.txt a10/ a9/ file1.txt file10.txt file2.txt"},
+		{nil, "sort=name-desc", "file2.txt file10.txt file1.txt a9/ a10/ File3.txt B/"},
+		{nil, "sort=natural", "B/ File3.txt a9/ a10/ file1.txt file2.txt file10.txt"},
+		{nil, "sort=natural-desc", "file10.txt file2.txt file1.txt a10/ a9/ File3.txt B/"},
+		{nil, "sort=natural&group=dirs", "B/ a9/ a10/ File3.txt file1.txt file2.txt file10.txt"},
+		{nil, "sort=natural-desc&group=dirs", "a10/ a9/ B/ file10.txt file2.txt file1.txt File3.txt"},
+		{nil, "sort=natural&group=dirs-last", "File3.txt file1.txt file2.txt file10.txt B/ a9/ a10/"},
+		{nil, "sort=natural-desc&group=dirs-last", "file10.txt file2.txt file1.txt File3.txt a10/ a9/ B/"},
+		{nil, "sort=size&group=dirs", "B/ a10/ a9/ file10.txt file2.txt file1.txt File3.txt"},
+		{nil, "sort=size-desc&group=dirs", "a9/ a10/ B/ File3.txt file1.txt file2.txt file10.txt"},
+		{nil, "sort=date", "file2.txt a9/ File3.txt file10.txt B/ file1.txt a10/"},
+		{nil, "sort=date-desc&group=dirs", "a10/ B/ a9/ file1.txt file10.txt File3.txt file2.txt"},
+		{map[*bool]bool{sortNatural: true}, "sort=name", "B/ File3.txt a9/ a10/ file1.txt file2.txt file10.txt"},
+		{map[*bool]bool{sortNatural: true}, "sort=size&group=dirs", "B/ a9/ a10/ file10.txt file2.txt file1.txt File3.txt"},
+		{map[*bool]bool{dirsFirst: true}, "sort=natural", "B/ a9/ a10/ File3.txt file1.txt file2.txt file10.txt"},
+		{map[*bool]bool{dirsFirst: true}, "sort=natural&group=none", "B/ File3.txt a9/ a10/ file1.txt file2.txt file10.txt"},
+		{map[*bool]bool{dirsFirst: true}, "sort=natural&group=dirs-last", "File3.txt file1.txt file2.txt file10.txt B/ a9/ a10/"},
+		{map[*bool]bool{dirsLast: true}, "sort=natural-desc", "file10.txt file2.txt file1.txt File3.txt a10/ a9/ B/"},
+		{nil, "sort=natural-asc", "400"},
+		{nil, "sort=desc", "400"},
+		{nil, "group=dirs-first", "400"},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			for p, v := range tt.flags {
+				setValue(t, p, v)
+			}
+			h := newTestHandler(t, root)
+			resp, body := get(h, "/?format=text&"+tt.query)
+			if resp.StatusCode != http.StatusOK {
+				if got := strconv.Itoa(resp.StatusCode); got != tt.want {
+					t.Fatalf("GET /?%s: status = %s, want %s", tt.query, got, tt.want)
+				}
+				return
+			}
+			if got := strings.Join(strings.Fields(body), " "); got != tt.want {
+				t.Errorf("GET /?%s:\ngot  %s\nwant %s", tt.query, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxFileCache is the maximum number of entries in a fileCache.
+const maxFileCache = 10000
+
+// fileCache caches information read from files, keyed by path.
+// An entry is valid as long as the modification time of the file is
+// unchanged. When the cache is full, the oldest entry is evicted.
+type fileCache[T any] struct {
+	mu      sync.Mutex
+	entries map[string]fileCacheEntry[T]
+	order   []string // keys in the order they were added
+}
+
+type fileCacheEntry[T any] struct {
+	modTime time.Time
+	value   T
+}
+
+func (c *fileCache[T]) get(name string, modTime time.Time) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok || !e.modTime.Equal(modTime) {
+		var zero T
+		return zero, false
+	}
+	return e.value, true
+}
+
+func (c *fileCache[T]) put(name string, modTime time.Time, v T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]fileCacheEntry[T])
+	}
+	if _, ok := c.entries[name]; !ok {
+		for len(c.order) >= maxFileCache {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, name)
+	}
+	c.entries[name] = fileCacheEntry[T]{modTime, v}
+}
+
+// maxImageSize is the maximum size of an image file to read the dimensions of.
+const maxImageSize = 64 << 20
+
+// imageConfigs caches the dimensions of image files.
+var imageConfigs fileCache[image.Config]
+
+// hasImageConfig reports whether readImageConfig supports the named file.
+func hasImageConfig(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gif", ".jpeg", ".jpg", ".png":
+		return true
+	}
+	return false
+}
+
+// readImageConfig reads the dimensions of the named GIF, JPEG, or PNG file
+// by decoding only its header, reporting the zero value if it cannot be read.
+func readImageConfig(dir fs.FS, name string, modTime time.Time) image.Config {
+	if c, ok := imageConfigs.get(name, modTime); ok {
+		return c
+	}
+	var c image.Config
+	if f, err := dir.Open(name); err == nil {
+		c, _, _ = image.DecodeConfig(f)
+		f.Close()
+	}
+	imageConfigs.put(name, modTime, c)
+	return c
+}
+
+// mediaDurations caches the durations of audio and video files.
+var mediaDurations fileCache[time.Duration]
+
+// hasMediaDuration reports whether readMediaDuration supports the named file.
+func hasMediaDuration(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".wav", ".flac", ".mp4", ".m4a", ".m4v", ".mov":
+		return true
+	}
+	return false
+}
+
+// readMediaDuration reads the duration of the named audio or video file
+// by parsing its container headers, reporting zero if it cannot be read.
+// It supports WAV, FLAC, and MP4 (including M4A, M4V, and QuickTime) files.
+func readMediaDuration(dir fs.FS, name string, modTime time.Time) time.Duration {
+	if d, ok := mediaDurations.get(name, modTime); ok {
+		return d
+	}
+	var d time.Duration
+	if f, err := dir.Open(name); err == nil {
+		if rs, ok := f.(io.ReadSeeker); ok {
+			switch strings.ToLower(path.Ext(name)) {
+			case ".wav":
+				d, _ = wavDuration(rs)
+			case ".flac":
+				d, _ = flacDuration(rs)
+			default:
+				d, _ = mp4Duration(rs)
+			}
+		}
+		f.Close()
+	}
+	mediaDurations.put(name, modTime, d)
+	return d
+}
+
+// errMediaFormat reports that the media file is malformed or unsupported.
+var errMediaFormat = errors.New("unsupported media format")
+
+// seconds converts a number of units at the given rate (per second)
+// to a duration, avoiding overflow for large numbers.
+func seconds(n, rate uint64) time.Duration {
+	return time.Duration(n/rate)*time.Second + time.Duration(n%rate)*time.Second/time.Duration(rate)
+}
+
+// wavDuration reads the duration of a RIFF WAVE file from the byte rate
+// in the "fmt " chunk and the size of the "data" chunk.
+func wavDuration(rs io.ReadSeeker) (time.Duration, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(rs, hdr[:]); err != nil {
+		return 0, err
+	}
+	if string(hdr[:4]) != "RIFF" || string(hdr[8:]) != "WAVE" {
+		return 0, errMediaFormat
+	}
+	var byteRate uint32
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(rs, chunk[:]); err != nil {
+			return 0, err
+		}
+		size := binary.LittleEndian.Uint32(chunk[4:])
+		switch string(chunk[:4]) {
+		case "fmt ":
+			var format [16]byte
+			if size < uint32(len(format)) {
+				return 0, errMediaFormat
+			}
+			if _, err := io.ReadFull(rs, format[:]); err != nil {
+				return 0, err
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:])
+			size -= uint32(len(format))
+		case "data":
+			if byteRate == 0 {
+				return 0, errMediaFormat
+			}
+			return seconds(uint64(size), uint64(byteRate)), nil
+		}
+		if _, err := rs.Seek(int64(size)+int64(size%2), io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// flacDuration reads the duration of a FLAC file from the sample rate
+// and number of samples in the STREAMINFO metadata block.
+func flacDuration(rs io.ReadSeeker) (time.Duration, error) {
+	var hdr [4 + 4 + 18]byte // magic, block header, and STREAMINFO
+	if _, err := io.ReadFull(rs, hdr[:]); err != nil {
+		return 0, err
+	}
+	if string(hdr[:4]) != "fLaC" || hdr[4]&0x7f != 0 {
+		return 0, errMediaFormat
+	}
+	info := binary.BigEndian.Uint64(hdr[8+10:])
+	rate, samples := info>>44, info&(1<<36-1) // 20-bit rate, 36-bit count
+	if rate == 0 || samples == 0 {
+		return 0, errMediaFormat
+	}
+	return seconds(samples, rate), nil
+}
+
+// mp4Duration reads the duration of an MP4 (or QuickTime) file from the
+// time scale and duration in the "mvhd" box within the "moov" box.
+func mp4Duration(rs io.ReadSeeker) (time.Duration, error) {
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	for pos, inMoov := int64(0), false; pos < end; {
+		var hdr [16]byte
+		if _, err := io.ReadFull(rs, hdr[:8]); err != nil {
+			return 0, err
+		}
+		size, hdrSize := int64(binary.BigEndian.Uint32(hdr[:4])), int64(8)
+		switch size {
+		case 0: // box extends to the end of the file
+			size = end - pos
+		case 1: // box has a 64-bit size
+			if _, err := io.ReadFull(rs, hdr[8:]); err != nil {
+				return 0, err
+			}
+			size, hdrSize = int64(binary.BigEndian.Uint64(hdr[8:])), 16
+		}
+		if size < hdrSize || pos+size > end {
+			return 0, errMediaFormat
+		}
+		switch typ := string(hdr[4:8]); {
+		case typ == "moov" && !inMoov:
+			// Descend into the children of the "moov" box.
+			pos, end, inMoov = pos+hdrSize, pos+size, true
+			continue
+		case typ == "mvhd" && inMoov:
+			var b [32]byte
+			n, _ := io.ReadFull(rs, b[:min(size-hdrSize, int64(len(b)))])
+			var scale, dur uint64
+			switch {
+			case n >= 20 && b[0] == 0: // version 0 has 32-bit times
+				scale, dur = uint64(binary.BigEndian.Uint32(b[12:])), uint64(binary.BigEndian.Uint32(b[16:]))
+				if dur == 1<<32-1 {
+					dur = 0 // unknown duration
+				}
+			case n >= 32 && b[0] == 1: // version 1 has 64-bit times
+				scale, dur = uint64(binary.BigEndian.Uint32(b[20:])), binary.BigEndian.Uint64(b[24:])
+				if dur == 1<<64-1 {
+					dur = 0 // unknown duration
+				}
+			}
+			if scale == 0 || dur == 0 {
+				return 0, errMediaFormat
+			}
+			return seconds(dur, scale), nil
+		}
+		pos += size
+		if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	return 0, errMediaFormat
+}
@@ -0,0 +1,148 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// whiteoutPrefix is the name prefix of a whiteout file.
+// A file named ".wh.foo" in one layer of an overlayFS hides
+// the file or directory named "foo" in all lower layers.
+// A directory that has a whiteout file for itself in the same layer
+// is opaque and hides the contents of that directory in all lower layers.
+const whiteoutPrefix = ".wh."
+
+// overlayFS is a union of file systems, where earlier (upper) layers
+// take precedence over later (lower) layers. A regular file in an upper
+// layer shadows any file or directory of the same name in lower layers,
+// while directories present in multiple layers have their entries merged.
+type overlayFS []fs.FS
+
+func (fsys overlayFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	var dir *overlayDir
+	for _, layer := range fsys {
+		f, err := layer.Open(name)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				if dir == nil {
+					return nil, err
+				}
+				break
+			}
+		} else if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+			if dir == nil {
+				return f, err // a file shadows all lower layers
+			}
+			f.Close()
+			break // a file in a lower layer stops the merging of directories
+		} else if dir == nil {
+			dir = &overlayDir{File: f, name: name, layers: []fs.FS{layer}}
+		} else {
+			f.Close()
+			dir.layers = append(dir.layers, layer)
+		}
+		if hasWhiteout(layer, name) {
+			break
+		}
+	}
+	if dir == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return dir, nil
+}
+
+// ReadLink reads the target of the named symbolic link
+// from the uppermost layer in which the name exists.
+func (fsys overlayFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	for _, layer := range fsys {
+		if rfs, ok := layer.(readLinkFS); ok {
+			target, err := rfs.ReadLink(name)
+			if !errors.Is(err, fs.ErrNotExist) {
+				return target, err
+			}
+		} else if _, err := fs.Stat(layer, name); !errors.Is(err, fs.ErrNotExist) {
+			return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+		}
+		if hasWhiteout(layer, name) {
+			break
+		}
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+}
+
+// hasWhiteout reports whether the layer has a whiteout file
+// for the named file or any of its parent directories.
+func hasWhiteout(layer fs.FS, name string) bool {
+	for ; name != "."; name = path.Dir(name) {
+		if _, err := fs.Stat(layer, path.Join(path.Dir(name), whiteoutPrefix+path.Base(name))); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// overlayDir is a directory in an overlayFS.
+// It reports the information of the directory in the uppermost layer,
+// but lists the merged entries of the directory across all layers.
+type overlayDir struct {
+	fs.File
+	name   string
+	layers []fs.FS // layers in which the directory exists
+
+	entries []fs.DirEntry // merged entries; nil until first read
+	offset  int
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		seen := make(map[string]bool) // names shadowed by upper layers
+		d.entries = []fs.DirEntry{}
+		for _, layer := range d.layers {
+			des, err := fs.ReadDir(layer, d.name)
+			if err != nil {
+				return nil, err
+			}
+			var whiteouts []string
+			for _, de := range des {
+				if strings.HasPrefix(de.Name(), whiteoutPrefix) {
+					whiteouts = append(whiteouts, strings.TrimPrefix(de.Name(), whiteoutPrefix))
+					continue
+				}
+				if !seen[de.Name()] {
+					seen[de.Name()] = true
+					d.entries = append(d.entries, de)
+				}
+			}
+			for _, name := range whiteouts {
+				seen[name] = true
+			}
+		}
+		sort.Slice(d.entries, func(i, j int) bool {
+			return d.entries[i].Name() < d.entries[j].Name()
+		})
+	}
+
+	entries := d.entries[d.offset:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	d.offset += len(entries)
+	return append([]fs.DirEntry(nil), entries...), nil
+}
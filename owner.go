@@ -0,0 +1,50 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// ownerNames caches the names of user and group IDs,
+// keyed by "u" or "g" followed by the ID.
+var ownerNames sync.Map
+
+// userName reports the name of the user ID, or the ID itself if unknown.
+func userName(uid int) string {
+	return lookupOwnerName("u", uid, func(id string) (string, error) {
+		u, err := user.LookupId(id)
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	})
+}
+
+// groupName reports the name of the group ID, or the ID itself if unknown.
+func groupName(gid int) string {
+	return lookupOwnerName("g", gid, func(id string) (string, error) {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			return "", err
+		}
+		return g.Name, nil
+	})
+}
+
+func lookupOwnerName(kind string, id int, lookup func(string) (string, error)) string {
+	s := strconv.Itoa(id)
+	if name, ok := ownerNames.Load(kind + s); ok {
+		return name.(string)
+	}
+	name, err := lookup(s)
+	if err != nil {
+		name = s
+	}
+	ownerNames.Store(kind+s, name)
+	return name
+}
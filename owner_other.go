@@ -0,0 +1,21 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// fileOwner reports the user and group IDs that own the file,
+// which are unavailable on this platform.
+func fileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// fileLinkCount reports the number of hard links to the file,
+// which is unavailable on this platform.
+func fileLinkCount(fi fs.FileInfo) (n int, ok bool) {
+	return 0, false
+}
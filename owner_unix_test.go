@@ -0,0 +1,72 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileOwner(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello"})
+	fi, err := os.Stat(filepath.Join(root, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, gid, ok := fileOwner(fi)
+	if !ok || uid != os.Getuid() || gid != os.Getgid() {
+		t.Errorf("fileOwner = (%d, %d, %v), want (%d, %d, true)", uid, gid, ok, os.Getuid(), os.Getgid())
+	}
+
+	// The owner is only listed with -show-owner.
+	h := newTestHandler(t, root)
+	if _, entries, _ := listing(t, h, "/"); entries["a.txt"].UID != nil || entries["a.txt"].GID != nil {
+		t.Errorf("owner is listed without -show-owner")
+	}
+	setValue(t, showOwner, true)
+	_, entries, _ := listing(t, h, "/")
+	e := entries["a.txt"]
+	if e.UID == nil || *e.UID != os.Getuid() || e.GID == nil || *e.GID != os.Getgid() {
+		t.Errorf("listed owner = (%v, %v), want (%d, %d)", e.UID, e.GID, os.Getuid(), os.Getgid())
+	}
+	if e.User != userName(os.Getuid()) || e.Group != groupName(os.Getgid()) {
+		t.Errorf("listed owner names = (%q, %q), want (%q, %q)", e.User, e.Group, userName(os.Getuid()), groupName(os.Getgid()))
+	}
+}
+
+func TestFileLinkCount(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello", "b.txt": "world"})
+	if err := os.Link(filepath.Join(root, "a.txt"), filepath.Join(root, "a-link.txt")); err != nil {
+		t.Skipf("hard links unsupported: %v", err)
+	}
+	for name, want := range map[string]int{"a.txt": 2, "a-link.txt": 2, "b.txt": 1} {
+		fi, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, ok := fileLinkCount(fi); !ok || n != want {
+			t.Errorf("fileLinkCount(%s) = (%d, %v), want (%d, true)", name, n, ok, want)
+		}
+	}
+
+	// The link count is only listed with -show-link-count.
+	h := newTestHandler(t, root)
+	if _, entries, _ := listing(t, h, "/"); entries["a.txt"].LinkCount != 0 {
+		t.Errorf("link count is listed without -show-link-count")
+	}
+	setValue(t, showLinkCount, true)
+	_, entries, _ := listing(t, h, "/")
+	if n := entries["a.txt"].LinkCount; n != 2 {
+		t.Errorf("listed link count of a.txt = %d, want 2", n)
+	}
+	if n := entries["b.txt"].LinkCount; n != 1 {
+		t.Errorf("listed link count of b.txt = %d, want 1", n)
+	}
+}
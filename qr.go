@@ -0,0 +1,457 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// serveQR serves a PNG image of a QR code that encodes
+// the absolute URL of the request (without the query).
+func serveQR(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: externalPrefix(r) + r.URL.Path}
+	modules, err := encodeQR([]byte(u.String()))
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	// Render each module as a square of pixels within a quiet zone.
+	const scale, quiet = 8, 4
+	n := len(modules)
+	img := image.NewPaletted(image.Rect(0, 0, (n+2*quiet)*scale, (n+2*quiet)*scale), color.Palette{color.White, color.Black})
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				for i := 0; i < scale*scale; i++ {
+					img.SetColorIndex((x+quiet)*scale+i%scale, (y+quiet)*scale+i/scale, 1)
+				}
+			}
+		}
+	}
+	var bb bytes.Buffer
+	if err := png.Encode(&bb, img); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(bb.Len()))
+	if r.Method != http.MethodHead {
+		w.Write(bb.Bytes())
+	}
+}
+
+// qrVersions are the block structures of QR code versions 1 to 10
+// at error correction level M. Each version has n1 blocks of d1 data
+// codewords followed by n2 blocks of d2 data codewords, where every
+// block has ec error correction codewords.
+var qrVersions = []struct{ ec, n1, d1, n2, d2 int }{
+	{10, 1, 16, 0, 0},
+	{16, 1, 28, 0, 0},
+	{26, 1, 44, 0, 0},
+	{18, 2, 32, 0, 0},
+	{24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0},
+	{18, 4, 31, 0, 0},
+	{22, 2, 38, 2, 39},
+	{22, 3, 36, 2, 37},
+	{26, 4, 43, 1, 44},
+}
+
+// qrAlignments are the alignment pattern positions of versions 1 to 10.
+var qrAlignments = [][]int{
+	nil,
+	{6, 18},
+	{6, 22},
+	{6, 26},
+	{6, 30},
+	{6, 34},
+	{6, 22, 38},
+	{6, 24, 42},
+	{6, 26, 46},
+	{6, 28, 50},
+}
+
+// encodeQR encodes data in byte mode as a QR code at error correction
+// level M, using the smallest version that fits. It reports the modules
+// of the symbol, indexed by row and then column, where true is dark.
+// Only versions up to 10 (213 bytes of data) are supported.
+func encodeQR(data []byte) ([][]bool, error) {
+	// Select the smallest version that can hold the data.
+	version := 0
+	var capacity int
+	for v, b := range qrVersions {
+		countBits := 8
+		if v+1 >= 10 {
+			countBits = 16
+		}
+		capacity = b.n1*b.d1 + b.n2*b.d2
+		if 4+countBits+8*len(data) <= 8*capacity {
+			version = v + 1
+			break
+		}
+	}
+	if version == 0 {
+		return nil, badRequestError("URL is too long to encode as a QR code")
+	}
+	blocks := qrVersions[version-1]
+
+	// Encode the data as a bit stream with a mode indicator and length,
+	// followed by a terminator and padding up to the capacity.
+	var bits []bool
+	appendBits := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (v>>i)&1 != 0)
+		}
+	}
+	appendBits(0b0100, 4)
+	if version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	appendBits(0, min(4, 8*capacity-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+	for pad := 0xec; len(bits) < 8*capacity; pad ^= 0xec ^ 0x11 {
+		appendBits(pad, 8)
+	}
+	codewords := make([]byte, capacity)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+
+	// Split the codewords into blocks, compute the error correction
+	// codewords of each block, and interleave all the blocks.
+	var dataBlocks, ecBlocks [][]byte
+	divisor := rsDivisor(blocks.ec)
+	for i := 0; i < blocks.n1+blocks.n2; i++ {
+		n := blocks.d1
+		if i >= blocks.n1 {
+			n = blocks.d2
+		}
+		dataBlocks = append(dataBlocks, codewords[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(codewords[:n], divisor))
+		codewords = codewords[n:]
+	}
+	var interleaved []byte
+	for i := 0; i < max(blocks.d1, blocks.d2); i++ {
+		for _, b := range dataBlocks {
+			if i < len(b) {
+				interleaved = append(interleaved, b[i])
+			}
+		}
+	}
+	for i := 0; i < blocks.ec; i++ {
+		for _, b := range ecBlocks {
+			interleaved = append(interleaved, b[i])
+		}
+	}
+
+	q := newQRSymbol(version)
+	q.placeData(interleaved)
+
+	// Select the mask with the lowest penalty.
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			bestMask, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // masks are undone by applying them again
+	}
+	q.applyMask(bestMask)
+	q.drawFormat(bestMask)
+	return q.modules, nil
+}
+
+// qrSymbol is a QR code symbol under construction.
+type qrSymbol struct {
+	size     int
+	modules  [][]bool // true for dark modules
+	function [][]bool // true for modules that are not data or error correction
+}
+
+// newQRSymbol returns a symbol of the given version
+// with all function patterns drawn.
+func newQRSymbol(version int) *qrSymbol {
+	size := 17 + 4*version
+	q := &qrSymbol{size: size}
+	for i := 0; i < size; i++ {
+		q.modules = append(q.modules, make([]bool, size))
+		q.function = append(q.function, make([]bool, size))
+	}
+
+	// Draw the timing patterns, then the finder patterns
+	// (with separators) in three of the corners.
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if 0 <= x && x < size && 0 <= y && y < size {
+					d := max(abs(dx), abs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	// Draw the alignment patterns, except where they overlap the finders.
+	pos := qrAlignments[version-1]
+	for i, x := range pos {
+		for j, y := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format information (drawn once the mask is chosen)
+	// and draw the version information.
+	q.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			a, b := size-11+i%3, i/3
+			q.set(a, b, (bits>>i)&1 != 0)
+			q.set(b, a, (bits>>i)&1 != 0)
+		}
+	}
+	return q
+}
+
+// set sets the function module at column x and row y.
+func (q *qrSymbol) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFormat draws both copies of the format information
+// for error correction level M and the given mask.
+func (q *qrSymbol) drawFormat(mask int) {
+	data := 0b00<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true) // the dark module
+}
+
+// placeData places the codewords in the zigzag order of the QR code,
+// starting from the bottom right corner in two-module wide columns.
+func (q *qrSymbol) placeData(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert // upwards
+				}
+				if !q.function[y][x] && i < 8*len(codewords) {
+					q.modules[y][x] = (codewords[i/8]>>(7-i%8))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the mask pattern.
+func (q *qrSymbol) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty computes the penalty score of the symbol,
+// where patterns that are harder to scan have a higher score.
+func (q *qrSymbol) penalty() int {
+	n := q.size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			x, y = y, x
+		}
+		return q.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	var score, dark int
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			// Penalize runs of five or more modules of the same color.
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+
+			// Penalize patterns similar to the finder patterns
+			// with four light modules on either side.
+			for x := 0; x+len(finder) <= n; x++ {
+				match := true
+				for i, d := range finder {
+					match = match && at(x+i, y, transpose) == d
+				}
+				if !match {
+					continue
+				}
+				for _, side := range []int{x - 4, x + len(finder)} {
+					light := 0 <= side && side+4 <= n
+					for i := 0; light && i < 4; i++ {
+						light = !at(side+i, y, transpose)
+					}
+					if light {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			// Penalize 2x2 blocks of the same color.
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+			if q.modules[y][x] {
+				dark++
+			}
+		}
+	}
+
+	// Penalize an unbalanced proportion of dark modules.
+	total := n * n
+	score += 10 * ((abs(20*dark-10*total)+total-1)/total - 1)
+	return score
+}
+
+// rsDivisor returns the coefficients of the Reed-Solomon generator
+// polynomial of the given degree, excluding the leading coefficient.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords of data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMul(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// gfMul multiplies two elements of GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
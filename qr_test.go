@@ -0,0 +1,176 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// The generator polynomials are listed as exponents of α,
+	// excluding the leading coefficient α^0 (see ISO/IEC 18004, Annex A).
+	log := make(map[byte]int)
+	for i, x := 0, byte(1); i < 255; i, x = i+1, gfMul(x, 0x02) {
+		if _, ok := log[x]; ok {
+			t.Fatalf("α^%d = α^%d, want a generator of GF(256)", i, log[x])
+		}
+		log[x] = i
+	}
+	for degree, want := range map[int][]int{
+		7:  {87, 229, 146, 149, 238, 102, 21},
+		10: {251, 67, 46, 61, 118, 70, 64, 94, 32, 45},
+	} {
+		var got []int
+		for _, c := range rsDivisor(degree) {
+			got = append(got, log[c])
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("rsDivisor(%d) = α^%v, want α^%v", degree, got, want)
+		}
+	}
+
+	// The error correction codewords of version 1-M symbols.
+	for _, tt := range []struct {
+		name     string
+		data, ec []byte
+	}{{
+		// ISO/IEC 18004, Annex I: "01234567" in numeric mode.
+		name: "01234567",
+		data: []byte{0x10, 0x20, 0x0c, 0x56, 0x61, 0x80, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11},
+		ec:   []byte{0xa5, 0x24, 0xd4, 0xc1, 0xed, 0x36, 0xc7, 0x87, 0x2c, 0x55},
+	}, {
+		// "HELLO WORLD" in alphanumeric mode.
+		name: "HELLO WORLD",
+		data: []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17},
+		ec:   []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23},
+	}} {
+		if got := rsRemainder(tt.data, rsDivisor(len(tt.ec))); !bytes.Equal(got, tt.ec) {
+			t.Errorf("%s: rsRemainder = % x, want % x", tt.name, got, tt.ec)
+		}
+	}
+}
+
+func TestQRInformation(t *testing.T) {
+	// The format information of level M for each mask
+	// (see ISO/IEC 18004, Annex C), where bit 14 is the first character.
+	for mask, want := range []string{
+		"101010000010010",
+		"101000100100101",
+		"101111001111100",
+		"101101101001011",
+		"100010111111001",
+		"100000011001110",
+		"100111110010111",
+		"100101010100000",
+	} {
+		q := newQRSymbol(1)
+		q.drawFormat(mask)
+		var bits int
+		for i := 0; i <= 5; i++ {
+			bits |= b2i(q.modules[i][8]) << i
+		}
+		bits |= b2i(q.modules[7][8])<<6 | b2i(q.modules[8][8])<<7 | b2i(q.modules[8][7])<<8
+		for i := 9; i < 15; i++ {
+			bits |= b2i(q.modules[8][14-i]) << i
+		}
+		if got := fmt.Sprintf("%015b", bits); got != want {
+			t.Errorf("format information for mask %d = %s, want %s", mask, got, want)
+		}
+	}
+
+	// The version information of version 7 (see ISO/IEC 18004, Annex D).
+	q := newQRSymbol(7)
+	var bits int
+	for i := 0; i < 18; i++ {
+		bits |= b2i(q.modules[i/3][q.size-11+i%3]) << i
+	}
+	if got, want := fmt.Sprintf("%018b", bits), "000111110010010100"; got != want {
+		t.Errorf("version information for version 7 = %s, want %s", got, want)
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestEncodeQR(t *testing.T) {
+	modules, err := encodeQR([]byte("https://example.com/files/a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bb bytes.Buffer
+	for _, row := range modules {
+		for _, dark := range row {
+			if dark {
+				bb.WriteString("##")
+			} else {
+				bb.WriteString("..")
+			}
+		}
+		bb.WriteString("\n")
+	}
+	checkGolden(t, "qr.golden", bb.Bytes())
+
+	// The smallest version that fits is used, up to version 10.
+	for _, tt := range []struct {
+		size    int
+		version int
+	}{{14, 1}, {15, 2}, {26, 2}, {27, 3}, {213, 10}, {214, 0}} {
+		modules, err := encodeQR(bytes.Repeat([]byte{'x'}, tt.size))
+		if tt.version == 0 {
+			if err == nil {
+				t.Errorf("encodeQR of %d bytes: unexpected success", tt.size)
+			}
+			continue
+		}
+		if err != nil || len(modules) != 17+4*tt.version {
+			t.Errorf("encodeQR of %d bytes = (%d modules, %v), want version %d", tt.size, len(modules), err, tt.version)
+		}
+	}
+}
+
+func TestServeQR(t *testing.T) {
+	root := t.TempDir()
+	long := strings.Repeat("x", 250) + ".txt"
+	writeFiles(t, root, map[string]string{"a.txt": "hello", long: ""})
+	h := newTestHandler(t, root)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		resp, body := serveRequest(h, httptest.NewRequest(method, "http://example.com/a.txt?qr=true", nil))
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+			t.Errorf("%s /a.txt?qr=true = (%d, %s), want (200, image/png)", method, resp.StatusCode, resp.Header.Get("Content-Type"))
+			continue
+		}
+		if method == http.MethodHead {
+			if body != "" || resp.Header.Get("Content-Length") == "" {
+				t.Errorf("HEAD /a.txt?qr=true: body = %d bytes, Content-Length = %q, want no body with a length", len(body), resp.Header.Get("Content-Length"))
+			}
+			continue
+		}
+		img, err := png.Decode(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("GET /a.txt?qr=true: invalid PNG: %v", err)
+		}
+		modules, _ := encodeQR([]byte("http://example.com/a.txt"))
+		if got, want := img.Bounds().Dx(), (len(modules)+8)*8; got != want {
+			t.Errorf("GET /a.txt?qr=true: image width = %d, want %d", got, want)
+		}
+	}
+
+	// URLs that are too long report an error rather than an image.
+	resp, body := get(h, "/"+long+"?qr=true")
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "too long") {
+		t.Errorf("GET /%s?qr=true = (%d, %.40q), want 400 with an error", long, resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateBurst is the duration of transfer at the full rate that
+// a rateLimiter permits immediately after being idle.
+const rateBurst = 100 * time.Millisecond
+
+// rateLimiter is a token bucket that limits a transfer rate.
+// It is implemented as a virtual scheduling algorithm, where each
+// reservation advances the time at which the bucket is next empty.
+type rateLimiter struct {
+	rate float64 // bytes per second
+
+	mu   sync.Mutex
+	next time.Time // time at which all reserved bytes are transferred
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: float64(rate)}
+}
+
+// chunkSize is the maximum number of bytes to reserve at once,
+// which is the number of bytes transferred within rateBurst.
+func (l *rateLimiter) chunkSize() int {
+	return max(int(l.rate*rateBurst.Seconds()), 1)
+}
+
+// wait reserves n bytes and blocks until they may be transferred,
+// or until the context is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.next = later(l.next, now).Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now) - rateBurst
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func later(x, y time.Time) time.Time {
+	if x.After(y) {
+		return x
+	}
+	return y
+}
+
+// totalRateLimiter limits the combined rate of all connections.
+// Since every transfer reserves at most a chunk of bytes at a time,
+// concurrent transfers take turns and share the rate fairly.
+// A transfer to a slow client reserves fewer bytes and does not
+// hold back the others.
+var totalRateLimiter *rateLimiter
+
+// rateLimiterKey is the context key for the rateLimiter of a connection.
+type rateLimiterKey struct{}
+
+// withRateLimiter returns a context for a new connection
+// with a rateLimiter of the -max-rate rate (if any).
+func withRateLimiter(ctx context.Context, c net.Conn) context.Context {
+	if *maxRate <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, rateLimiterKey{}, newRateLimiter(*maxRate))
+}
+
+// rateLimitedReader is an io.ReadSeeker whose reads are limited
+// by the rate of every limiter.
+type rateLimitedReader struct {
+	ctx      context.Context
+	rs       io.ReadSeeker
+	limiters []*rateLimiter
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	for _, l := range r.limiters {
+		b = b[:min(len(b), l.chunkSize())]
+	}
+	n, err := r.rs.Read(b)
+	for _, l := range r.limiters {
+		if err := l.wait(r.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (r *rateLimitedReader) Seek(offset int64, whence int) (int64, error) {
+	return r.rs.Seek(offset, whence)
+}
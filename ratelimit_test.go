@@ -0,0 +1,85 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow test in short mode")
+	}
+	const rate = 1 << 20
+	const size = 3 << 19 // 1.5 MiB
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "large.bin"), bytes.Repeat([]byte{'x'}, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := openRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFlagsConfig(t, dir)
+
+	// download downloads the file n times concurrently over separate
+	// connections and reports the elapsed time. Each call uses a new server,
+	// which is closed before the flags are changed for the next call.
+	download := func(n int) time.Duration {
+		srv := httptest.NewUnstartedServer(newHandler(dir))
+		srv.Config.ConnContext = withRateLimiter
+		srv.Start()
+		defer srv.Close()
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c := &http.Client{Transport: srv.Client().Transport.(*http.Transport).Clone()}
+				resp, err := c.Get(srv.URL + "/large.bin")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer resp.Body.Close()
+				if n, err := io.Copy(io.Discard, resp.Body); err != nil || n != size {
+					t.Errorf("downloaded %d bytes: %v", n, err)
+				}
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+
+	// Transfers start with a burst, after which they are sent at the rate.
+	// Thus, the elapsed time is slightly less than size/rate.
+	want := time.Duration(float64(size)/rate*float64(time.Second)) - rateBurst
+	check := func(name string, got time.Duration) {
+		t.Helper()
+		if got < want*9/10 || got > want*2 {
+			t.Errorf("%s: took %v, want about %v", name, got, want)
+		}
+	}
+
+	// Each connection is limited separately by -max-rate.
+	setValue(t, maxRate, rate)
+	check("one connection", download(1))
+	check("two connections", download(2))
+
+	// All connections are limited together by -max-total-rate.
+	setValue(t, maxRate, 0)
+	setValue(t, &totalRateLimiter, newRateLimiter(2*rate))
+	check("two connections with a total rate", download(2))
+}
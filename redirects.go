@@ -0,0 +1,123 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// redirectsFile is the name of the file in the root directory
+// with rules for redirecting requests.
+const redirectsFile = "_redirects"
+
+// isRedirectsFile reports whether the URL path refers to the redirects file,
+// which is never listed, served, appended to, or reported by /.stat.
+func isRedirectsFile(urlPath string) bool {
+	return strings.TrimSuffix(urlPath, "/") == "/"+redirectsFile
+}
+
+// redirectRule redirects requests for a path to another URL.
+type redirectRule struct {
+	from   string // URL path, where a trailing "*" matches any suffix
+	to     string // URL, where ":splat" is replaced by the suffix matched by "*"
+	status int
+	force  bool // whether the rule applies even if a file exists at the path
+}
+
+// readRedirects reads the redirect rules from the redirects file
+// in the root directory, reporting no rules if the file does not exist.
+func readRedirects(dir fs.FS) ([]redirectRule, error) {
+	b, err := fs.ReadFile(dir, redirectsFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseRedirects(b)
+}
+
+// parseRedirects parses redirect rules, one per line, of the form
+// "from to [status]" (similar to the _redirects file of Netlify).
+// The status defaults to 301, and a trailing "!" on the status forces
+// the rule to apply even if a file exists at the path.
+// Empty lines and lines starting with '#' are ignored.
+func parseRedirects(b []byte) ([]redirectRule, error) {
+	var rules []redirectRule
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected 'from to [status]'", redirectsFile, n)
+		}
+		rule := redirectRule{from: fields[0], to: fields[1], status: http.StatusMovedPermanently}
+		if !strings.HasPrefix(rule.from, "/") || strings.Contains(strings.TrimSuffix(rule.from, "*"), "*") {
+			return nil, fmt.Errorf("%s:%d: invalid path %q", redirectsFile, n, rule.from)
+		}
+		if len(fields) == 3 {
+			switch status, _ := strconv.Atoi(strings.TrimSuffix(fields[2], "!")); status {
+			case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+				rule.status = status
+				rule.force = strings.HasSuffix(fields[2], "!")
+			default:
+				return nil, fmt.Errorf("%s:%d: unsupported status %q", redirectsFile, n, fields[2])
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, s.Err()
+}
+
+// matchRedirect reports the URL and status to redirect the URL path to
+// according to the first matching rule. A trailing slash is insignificant.
+// If a file exists at the path, only forced rules are matched.
+func matchRedirect(rules []redirectRule, urlPath string, exists bool) (to string, status int, ok bool) {
+	p := strings.TrimSuffix(urlPath, "/")
+	for _, rule := range rules {
+		if exists && !rule.force {
+			continue
+		}
+		from := strings.TrimSuffix(rule.from, "/")
+		if prefix, ok := strings.CutSuffix(from, "*"); ok {
+			prefix = strings.TrimSuffix(prefix, "/")
+			if splat, ok := strings.CutPrefix(p, prefix); ok && (splat == "" || splat[0] == '/') {
+				splat = strings.TrimPrefix(splat, "/")
+				if strings.HasSuffix(urlPath, "/") && splat != "" {
+					splat += "/"
+				}
+				splat = (&url.URL{Path: splat}).EscapedPath()
+				return strings.ReplaceAll(rule.to, ":splat", splat), rule.status, true
+			}
+		} else if p == from {
+			return rule.to, rule.status, true
+		}
+	}
+	return "", 0, false
+}
+
+// serveRedirect redirects the request to the URL with the status,
+// where the URL is relative to the external prefix if it is a path.
+// The query string is preserved unless the URL has its own.
+func serveRedirect(w http.ResponseWriter, r *http.Request, to string, status int) {
+	if strings.HasPrefix(to, "/") && !strings.HasPrefix(to, "//") {
+		to = externalPrefix(r) + to
+	}
+	if q := r.URL.RawQuery; q != "" && !strings.Contains(to, "?") {
+		to += "?" + q
+	}
+	w.Header().Set("Location", to)
+	w.WriteHeader(status)
+}
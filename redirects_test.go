@@ -0,0 +1,173 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseRedirects(t *testing.T) {
+	rules, err := parseRedirects([]byte(`
+# Comments and empty lines are ignored.
+
+/old.html   /new.html
+/blog/*     /posts/:splat   302
+/draft.html /               303!
+/chat       https://example.com/chat 307
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []redirectRule{
+		{from: "/old.html", to: "/new.html", status: 301},
+		{from: "/blog/*", to: "/posts/:splat", status: 302},
+		{from: "/draft.html", to: "/", status: 303, force: true},
+		{from: "/chat", to: "https://example.com/chat", status: 307},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("parseRedirects: got %d rules, want %d", len(rules), len(want))
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i, rules[i], want[i])
+		}
+	}
+
+	for _, in := range []string{
+		"/old.html",                 // missing destination
+		"/old.html /new.html 301 x", // too many fields
+		"old.html /new.html",        // relative path
+		"/a*b /new.html",            // "*" not at the end
+		"/old.html /new.html 200",   // not a redirect status
+		"/old.html /new.html 301!!", // invalid force suffix
+		"/old.html /new.html moved", // not a number
+		"/ok /new.html\n/bad",       // invalid line after a valid one
+	} {
+		if _, err := parseRedirects([]byte(in)); err == nil {
+			t.Errorf("parseRedirects(%q): unexpected success", in)
+		}
+	}
+}
+
+func TestMatchRedirect(t *testing.T) {
+	rules := []redirectRule{
+		{from: "/old.html", to: "/new.html", status: 301},
+		{from: "/blog/*", to: "/posts/:splat", status: 302},
+		{from: "/forced/", to: "/elsewhere/", status: 307, force: true},
+		{from: "/*", to: "/index.html", status: 302},
+	}
+	for _, tt := range []struct {
+		path   string
+		exists bool
+		to     string
+		status int
+	}{
+		{"/old.html", false, "/new.html", 301},
+		{"/old.html/", false, "/new.html", 301}, // trailing slash is insignificant
+		{"/old.html", true, "", 0},              // shadowed by the file
+		{"/blog", false, "/posts/", 302},
+		{"/blog/", false, "/posts/", 302},
+		{"/blog/2021/post", false, "/posts/2021/post", 302},
+		{"/blog/2021/", false, "/posts/2021/", 302},
+		{"/blog/a b", false, "/posts/a%20b", 302},
+		{"/blogs", false, "/index.html", 302}, // only whole path elements match
+		{"/forced", true, "/elsewhere/", 307},
+		{"/forced/", false, "/elsewhere/", 307},
+		{"/index.html", true, "", 0}, // no redirect loop for files that exist
+		{"/missing", false, "/index.html", 302},
+	} {
+		to, status, ok := matchRedirect(rules, tt.path, tt.exists)
+		if to != tt.to || status != tt.status || ok != (tt.status != 0) {
+			t.Errorf("matchRedirect(%q, %v) = (%q, %d, %v), want (%q, %d, %v)", tt.path, tt.exists, to, status, ok, tt.to, tt.status, tt.status != 0)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		redirectsFile:  "/old.html /new.html\n/blog/* /posts/:splat 302\n/shadowed.txt /new.html\n/forced.txt /new.html 302!\n",
+		"new.html":     "new",
+		"shadowed.txt": "shadowed",
+		"forced.txt":   "forced",
+	})
+	setValue(t, prefix, "/files")
+	_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+	setValue(t, &trustedNets, []*net.IPNet{trusted})
+	h := newTestHandler(t, root)
+
+	for _, tt := range []struct {
+		target   string
+		fwdPfx   string
+		status   int
+		location string
+		body     string
+	}{
+		{target: "/files/old.html", status: 301, location: "/files/new.html"},
+		{target: "/files/old.html?x=1", status: 301, location: "/files/new.html?x=1"},
+		{target: "/files/blog/a/b", status: 302, location: "/files/posts/a/b"},
+		{target: "/files/blog/a/b", fwdPfx: "/proxy", status: 302, location: "/proxy/files/posts/a/b"},
+		{target: "/files/shadowed.txt", status: 200, body: "shadowed"},
+		{target: "/files/forced.txt", status: 302, location: "/files/new.html"},
+		{target: "/files/" + redirectsFile, status: 404},
+		{target: "/files/" + redirectsFile + "/", status: 404},
+		{target: "/files/sub/../" + redirectsFile, status: 404},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.fwdPfx != "" {
+			r.Header.Set("X-Forwarded-Prefix", tt.fwdPfx)
+		}
+		resp, body := serveRequest(h, r)
+		if resp.StatusCode != tt.status || resp.Header.Get("Location") != tt.location {
+			t.Errorf("GET %s with X-Forwarded-Prefix %q = (%d, %q), want (%d, %q)", tt.target, tt.fwdPfx, resp.StatusCode, resp.Header.Get("Location"), tt.status, tt.location)
+		}
+		if tt.body != "" && body != tt.body {
+			t.Errorf("GET %s: body = %q, want %q", tt.target, body, tt.body)
+		}
+	}
+
+	// The redirects file is not listed.
+	if _, entries, _ := listing(t, h, "/files/"); len(entries) == 0 {
+		t.Errorf("GET /files/: no listing")
+	} else if _, ok := entries[redirectsFile]; ok {
+		t.Errorf("GET /files/: %s is listed", redirectsFile)
+	}
+
+	// Nor is it reported by any other means.
+	r := httptest.NewRequest(http.MethodHead, "/files/"+redirectsFile, nil)
+	if resp, _ := serveRequest(h, r); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD /files/%s: status = %d, want 404", redirectsFile, resp.StatusCode)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/files"+statPath, strings.NewReader(`{"paths": ["/`+redirectsFile+`"]}`))
+	if resp, body := serveRequest(h, r); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"status":404`) {
+		t.Errorf("POST /files%s for %s = (%d, %s), want (200, status 404)", statPath, redirectsFile, resp.StatusCode, body)
+	}
+	r = httptest.NewRequest(methodPropfind, "/files/"+redirectsFile, nil)
+	if resp, _ := serveRequest(h, r); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("PROPFIND /files/%s: status = %d, want 404", redirectsFile, resp.StatusCode)
+	}
+	r = httptest.NewRequest(methodPropfind, "/files/", nil)
+	r.Header.Set("Depth", "1")
+	if resp, body := serveRequest(h, r); resp.StatusCode != http.StatusMultiStatus || !strings.Contains(body, "new.html") || strings.Contains(body, redirectsFile) {
+		t.Errorf("PROPFIND /files/ with Depth 1 = (%d, %s), want 207 without %s", resp.StatusCode, body, redirectsFile)
+	}
+
+	// Nor can it be appended to, even if the append pattern matches it.
+	setValue(t, &appendRx, regexp.MustCompile(`.*`))
+	r = httptest.NewRequest(http.MethodPost, "/files/"+redirectsFile, strings.NewReader("/new.html /elsewhere 302!\n"))
+	if resp, _ := serveRequest(h, r); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /files/%s: status = %d, want 405", redirectsFile, resp.StatusCode)
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, redirectsFile)); strings.Contains(string(b), "elsewhere") {
+		t.Errorf("POST /files/%s: appended to the file", redirectsFile)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sharePath is the URL path of signed share links.
+const sharePath = "/.share"
+
+// Incorrect passwords for a password-protected share link are limited
+// to maxShareAttempts within each shareAttemptWindow, after which further
+// attempts are refused until the window ends. Attempts are tracked
+// for at most maxShareAttemptLinks links at a time, beyond which
+// the record with the oldest window is forgotten.
+const (
+	maxShareAttempts     = 5
+	shareAttemptWindow   = 15 * time.Minute
+	maxShareAttemptLinks = 10000
+)
+
+// errTooManyAttempts is reported when a share link has had
+// too many incorrect passwords.
+var errTooManyAttempts = errors.New("too many incorrect passwords")
+
+// shareAttempts records the incorrect passwords for share links,
+// keyed by the signature of the link.
+var shareAttempts struct {
+	sync.Mutex
+	m map[string]shareAttempt
+}
+
+type shareAttempt struct {
+	start time.Time // start of the current window
+	count int       // number of incorrect passwords within the window
+}
+
+// checkShareAttempts reports how long until the password of the share link
+// with the signature may be attempted, which is zero if it may be now.
+func checkShareAttempts(sig string, now time.Time) time.Duration {
+	shareAttempts.Lock()
+	defer shareAttempts.Unlock()
+	a := shareAttempts.m[sig]
+	if end := a.start.Add(shareAttemptWindow); a.count >= maxShareAttempts && now.Before(end) {
+		return end.Sub(now)
+	}
+	return 0
+}
+
+// recordShareAttempt records an incorrect password for the share link
+// with the signature.
+func recordShareAttempt(sig string, now time.Time) {
+	shareAttempts.Lock()
+	defer shareAttempts.Unlock()
+	a, ok := shareAttempts.m[sig]
+	if !ok {
+		pruneShareAttempts(now)
+	}
+	if !now.Before(a.start.Add(shareAttemptWindow)) {
+		a = shareAttempt{start: now}
+	}
+	a.count++
+	if shareAttempts.m == nil {
+		shareAttempts.m = make(map[string]shareAttempt)
+	}
+	shareAttempts.m[sig] = a
+}
+
+// pruneShareAttempts makes room for another record if there are too many
+// by removing the records of windows that have ended, or otherwise the record
+// with the oldest window. Since the password is part of the signature,
+// the signature of a password-protected link cannot be verified before
+// the password is, so this ensures that incorrect passwords for bogus links
+// never prevent passwords for other links from being attempted.
+// The shareAttempts lock must be held.
+func pruneShareAttempts(now time.Time) {
+	if len(shareAttempts.m) < maxShareAttemptLinks {
+		return
+	}
+	var oldest string
+	for sig, a := range shareAttempts.m {
+		if !now.Before(a.start.Add(shareAttemptWindow)) {
+			delete(shareAttempts.m, sig)
+		} else if oldest == "" || a.start.Before(shareAttempts.m[oldest].start) {
+			oldest = sig
+		}
+	}
+	if len(shareAttempts.m) >= maxShareAttemptLinks {
+		delete(shareAttempts.m, oldest)
+	}
+}
+
+// shareSignature computes the signature of a share link for the file path
+// that expires at the given Unix time, using the -share-secret key.
+//
+// The password of a password-protected share link is part of the signed
+// message, but not part of the link itself. Thus, the server verifies the
+// password by verifying the signature, without storing the share, and the
+// password cannot be guessed offline without knowing the secret.
+func shareSignature(p string, exp int64, password string) string {
+	m := hmac.New(sha256.New, []byte(*shareSecret))
+	m.Write([]byte(p + "\n" + strconv.FormatInt(exp, 10)))
+	if password != "" {
+		m.Write([]byte("\n" + password))
+	}
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// shareURL returns the URL (relative to the host) of a share link
+// for the file path that expires at the given time.
+// If the password is non-empty, the link is password-protected.
+func shareURL(p string, exp time.Time, password string) string {
+	p = path.Clean("/" + p)
+	q := url.Values{
+		"path": {p},
+		"exp":  {strconv.FormatInt(exp.Unix(), 10)},
+		"sig":  {shareSignature(p, exp.Unix(), password)},
+	}
+	if password != "" {
+		q.Set("pw", "1")
+	}
+	return *prefix + sharePath + "?" + q.Encode()
+}
+
+// serveShare serves the file of a share link after verifying that
+// the link has a valid signature and has not expired.
+// Files served through share links are exempt from the deny pattern.
+//
+// For a password-protected link, a GET request serves a form that
+// submits the password in a POST request, which serves the file
+// if the password is correct.
+func serveShare(w http.ResponseWriter, r *http.Request, dir fs.FS) {
+	q := r.URL.Query()
+	p := q.Get("path")
+	exp, expErr := strconv.ParseInt(q.Get("exp"), 10, 64)
+	sig, sigErr := base64.RawURLEncoding.DecodeString(q.Get("sig"))
+	if expErr != nil || sigErr != nil || len(sig) != sha256.Size || p == "" || p != path.Clean("/"+p) || hasDotDot(p) {
+		httpError(w, r, badRequestError("invalid share link"))
+		return
+	}
+	if time.Now().Unix() > exp {
+		httpError(w, r, fmt.Errorf("%w: share link expired", fs.ErrPermission))
+		return
+	}
+	var password string
+	if q.Get("pw") == "1" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Cache-Control", "no-store")
+			renderTemplate(w, r, http.StatusOK, "", "share.html", sharePage{Name: path.Base(p)})
+			return
+		}
+		now := time.Now()
+		if d := checkShareAttempts(q.Get("sig"), now); d > 0 {
+			logger.Info("too many incorrect share passwords", "path", p, "remote", r.RemoteAddr)
+			w.Header().Set("Retry-After", strconv.Itoa(int(d.Round(time.Second).Seconds())))
+			httpError(w, r, errTooManyAttempts)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+		password = r.PostFormValue("password")
+		if password == "" || !hmac.Equal([]byte(q.Get("sig")), []byte(shareSignature(p, exp, password))) {
+			logger.Info("incorrect share password", "path", p, "remote", r.RemoteAddr)
+			recordShareAttempt(q.Get("sig"), now)
+			w.Header().Set("Cache-Control", "no-store")
+			renderTemplate(w, r, http.StatusForbidden, "", "share.html", sharePage{Name: path.Base(p), Incorrect: true})
+			return
+		}
+	} else if !hmac.Equal([]byte(q.Get("sig")), []byte(shareSignature(p, exp, ""))) {
+		httpError(w, r, badRequestError("invalid share link"))
+		return
+	}
+
+	name := filepath.Join(".", filepath.FromSlash(p))
+	f, err := dir.Open(name)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		httpError(w, r, badRequestError("shared path is not a file"))
+		return
+	}
+	w.Header().Set("Cache-Control", "private")
+	r.URL.Path = p // determines the Content-Type
+	serveFile(w, r, f, fi.ModTime())
+}
@@ -0,0 +1,224 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShare(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt":         "hello",
+		"secret/b.txt":  "world",
+		"sub/":          "",
+		"sub/../c..txt": "dots",
+	})
+	setValue(t, shareSecret, "secret key")
+	setValue(t, deny, "^/secret/")
+	h := newTestHandler(t, root)
+
+	// tamper returns the share link with the query parameter set to v,
+	// or deleted if v is empty.
+	tamper := func(link, k, v string) string {
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		if v == "" {
+			q.Del(k)
+		} else {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	future := time.Now().Add(time.Hour)
+	valid := shareURL("/a.txt", future, "")
+	for _, tt := range []struct {
+		name   string
+		link   string
+		status int
+		body   string
+	}{
+		{"valid", valid, http.StatusOK, "hello"},
+		{"denied path", shareURL("/secret/b.txt", future, ""), http.StatusOK, "world"},
+		{"expired", shareURL("/a.txt", time.Now().Add(-time.Second), ""), http.StatusForbidden, ""},
+		{"missing file", shareURL("/missing.txt", future, ""), http.StatusNotFound, ""},
+		{"directory", shareURL("/sub", future, ""), http.StatusBadRequest, ""},
+		{"tampered path", tamper(valid, "path", "/secret/b.txt"), http.StatusBadRequest, ""},
+		{"tampered exp", tamper(valid, "exp", "99999999999"), http.StatusBadRequest, ""},
+		{"tampered sig", tamper(valid, "sig", "AAAA"), http.StatusBadRequest, ""},
+		{"missing sig", tamper(valid, "sig", ""), http.StatusBadRequest, ""},
+		{"missing path", tamper(valid, "path", ""), http.StatusBadRequest, ""},
+		{"missing exp", tamper(valid, "exp", ""), http.StatusBadRequest, ""},
+		{"invalid exp", tamper(valid, "exp", "tomorrow"), http.StatusBadRequest, ""},
+		{"unclean path", tamper(valid, "path", "/sub/../a.txt"), http.StatusBadRequest, ""},
+		{"relative path", tamper(valid, "path", "a.txt"), http.StatusBadRequest, ""},
+		{"dot-dot path", tamper(valid, "path", "/../a.txt"), http.StatusBadRequest, ""},
+	} {
+		resp, body := get(h, tt.link)
+		if resp.StatusCode != tt.status || (tt.body != "" && body != tt.body) {
+			t.Errorf("%s: GET %s = (%d, %.20q), want (%d, %q)", tt.name, tt.link, resp.StatusCode, body, tt.status, tt.body)
+		}
+	}
+
+	// A signature from another secret is invalid.
+	other := shareURL("/a.txt", future, "")
+	setValue(t, shareSecret, "other key")
+	if resp, _ := get(h, other); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("link signed with another secret: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello", "b.txt": "world"})
+	setValue(t, shareSecret, "secret key")
+	setValue(t, &shareAttempts.m, nil)
+	h := newTestHandler(t, root)
+
+	post := func(link, password string, form bool) (*http.Response, string) {
+		body := url.Values{"password": {password}}.Encode()
+		if !form {
+			body = ""
+		}
+		r := httptest.NewRequest(http.MethodPost, link, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveRequest(h, r)
+	}
+	link := shareURL("/a.txt", time.Now().Add(time.Hour), "hunter2")
+
+	// A GET request serves the password form.
+	if resp, body := get(h, link); resp.StatusCode != http.StatusOK || !strings.Contains(body, `type="password"`) {
+		t.Errorf("GET %s = (%d, %.20q), want the password form", link, resp.StatusCode, body)
+	}
+
+	// Only the correct password serves the file.
+	for _, tt := range []struct {
+		password string
+		form     bool
+		status   int
+	}{
+		{"hunter2", true, http.StatusOK},
+		{"hunter3", true, http.StatusForbidden},
+		{"", true, http.StatusForbidden},
+		{"", false, http.StatusForbidden},
+	} {
+		resp, body := post(link, tt.password, tt.form)
+		if resp.StatusCode != tt.status {
+			t.Errorf("POST password %q: status = %d, want %d", tt.password, resp.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusOK && body != "hello" {
+			t.Errorf("POST password %q: body = %q, want %q", tt.password, body, "hello")
+		}
+	}
+	unsigned := strings.Replace(link, "pw=1", "pw=0", 1)
+	if resp, _ := get(h, unsigned); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET without the password: status = %d, want 400", resp.StatusCode)
+	}
+
+	// After too many incorrect passwords, even the correct one is refused.
+	for range maxShareAttempts {
+		post(link, "guess", true)
+	}
+	resp, _ := post(link, "hunter2", true)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("POST after too many attempts: status = %d, Retry-After = %q, want 429 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// Other links are unaffected.
+	other := shareURL("/b.txt", time.Now().Add(time.Hour), "hunter2")
+	if resp, body := post(other, "hunter2", true); resp.StatusCode != http.StatusOK || body != "world" {
+		t.Errorf("POST to another link = (%d, %q), want (200, %q)", resp.StatusCode, body, "world")
+	}
+}
+
+func TestShareAttempts(t *testing.T) {
+	setValue(t, &shareAttempts.m, nil)
+	now := time.Now()
+	for i := range maxShareAttempts {
+		if d := checkShareAttempts("sig", now); d != 0 {
+			t.Fatalf("attempt %d: refused for %v", i+1, d)
+		}
+		recordShareAttempt("sig", now.Add(time.Duration(i)*time.Second))
+	}
+	if d := checkShareAttempts("sig", now.Add(time.Minute)); d != shareAttemptWindow-time.Minute {
+		t.Errorf("after %d attempts: refused for %v, want %v", maxShareAttempts, d, shareAttemptWindow-time.Minute)
+	}
+	if d := checkShareAttempts("sig", now.Add(shareAttemptWindow)); d != 0 {
+		t.Errorf("after the window: refused for %v, want 0", d)
+	}
+
+	// Once too many links are tracked, windows that ended are pruned,
+	// or else the record with the oldest window is forgotten.
+	for i := range maxShareAttemptLinks - 1 {
+		recordShareAttempt(strconv.Itoa(i), now.Add(time.Duration(i+1)*time.Millisecond))
+	}
+	recordShareAttempt("new", now.Add(time.Minute))
+	if _, ok := shareAttempts.m["sig"]; ok {
+		t.Errorf("with too many links: the oldest record is kept")
+	}
+	if n := len(shareAttempts.m); n != maxShareAttemptLinks {
+		t.Errorf("%d records, want %d", n, maxShareAttemptLinks)
+	}
+	recordShareAttempt("newer", now.Add(shareAttemptWindow+30*time.Second))
+	if n := len(shareAttempts.m); n != 2 {
+		t.Errorf("%d records after pruning ended windows, want 2", n)
+	}
+}
+
+func TestShareAttemptsFlood(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello"})
+	setValue(t, shareSecret, "secret key")
+	setValue(t, &shareAttempts.m, nil)
+	h := newTestHandler(t, root)
+
+	post := func(link, password string) (*http.Response, string) {
+		r := httptest.NewRequest(http.MethodPost, link, strings.NewReader(url.Values{"password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveRequest(h, r)
+	}
+	link := shareURL("/a.txt", time.Now().Add(time.Hour), "hunter2")
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Malformed signatures are rejected without being recorded.
+	q := u.Query()
+	q.Set("sig", "bogus")
+	u.RawQuery = q.Encode()
+	if resp, _ := post(u.String(), "guess"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST with a malformed signature: status = %d, want 400", resp.StatusCode)
+	}
+	if n := len(shareAttempts.m); n != 0 {
+		t.Errorf("%d records after a malformed signature, want 0", n)
+	}
+
+	// Incorrect passwords for more bogus links than are tracked
+	// do not prevent the password of a valid link from being attempted.
+	for i := range maxShareAttemptLinks + 1 {
+		q.Set("sig", shareSignature("/a.txt", 0, strconv.Itoa(i)))
+		u.RawQuery = q.Encode()
+		if resp, _ := post(u.String(), "guess"); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("POST with bogus signature %d: status = %d, want 403", i, resp.StatusCode)
+		}
+	}
+	if n := len(shareAttempts.m); n != maxShareAttemptLinks {
+		t.Errorf("%d records, want %d", n, maxShareAttemptLinks)
+	}
+	if resp, body := post(link, "hunter2"); resp.StatusCode != http.StatusOK || body != "hello" {
+		t.Errorf("POST to a valid link after a flood = (%d, %.20q), want (200, %q)", resp.StatusCode, body, "hello")
+	}
+}
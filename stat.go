@@ -0,0 +1,118 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// statPath is the URL path that reports information about many files at once.
+const statPath = "/.stat"
+
+// statResult is the information about a single path of a bulk stat request.
+// Exactly one of fileInfo or Error is set.
+type statResult struct {
+	Path string `json:"path"`
+	*fileInfo
+	Error  string `json:"error,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// serveStat serves a POST request with a JSON body of the form
+// {"paths": [...]}, reporting an array of information about each path.
+// Paths are relative to the root directory and are subject to the
+// hide and deny patterns, where hidden paths are reported as not existing.
+func serveStat(w http.ResponseWriter, r *http.Request, cfg *config, dir fs.FS) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, r, errMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			httpError(w, r, err)
+		} else {
+			httpError(w, r, badRequestError(fmt.Sprintf("invalid request body: %v", err)))
+		}
+		return
+	}
+	if len(req.Paths) > *statMax {
+		httpError(w, r, badRequestError(fmt.Sprintf("too many paths (limit %d)", *statMax)))
+		return
+	}
+
+	results := make([]statResult, len(req.Paths))
+	for i, p := range req.Paths {
+		results[i].Path = p
+		fi, err := statPathInfo(cfg, dir, p)
+		if err != nil {
+			results[i].Status = httpStatus(err)
+			if results[i].Status == http.StatusNotFound && *denyNotFound {
+				err = fs.ErrNotExist // indistinguishable from denied paths
+			}
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].fileInfo = fi
+	}
+	b, err := json.Marshal(results)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// statPathInfo reports information about the file at the URL path p.
+func statPathInfo(cfg *config, dir fs.FS, p string) (*fileInfo, error) {
+	if !strings.HasPrefix(p, "/") || strings.IndexFunc(p, isControl) >= 0 {
+		return nil, badRequestError("invalid path")
+	}
+	p = path.Clean(p)
+	if hasDotDot(p) {
+		return nil, badRequestError("invalid path")
+	}
+	fi, err := fs.Stat(dir, filepath.Join(".", filepath.FromSlash(p)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the patterns against the canonical path, which has a trailing
+	// slash for directories, similar to requests for the path itself.
+	if fi.IsDir() && p != "/" {
+		p += "/"
+	}
+	// Hidden paths are reported as for direct requests with -hide-strict.
+	if strictlyHidden(cfg, p) || isRedirectsFile(p) {
+		return nil, os.ErrNotExist
+	}
+	if regexpMatch(cfg.denyRx, p) {
+		return nil, errDenied()
+	}
+	name := fi.Name()
+	if fi.IsDir() {
+		name += "/"
+	}
+	var size int64
+	if fi.Mode().IsRegular() {
+		size = fi.Size()
+	}
+	info := &fileInfo{Name: name, Mode: fi.Mode(), Size: size, ModTime: fi.ModTime(), Kind: fileKind(name)}
+	if !fi.IsDir() {
+		info.SizeText = formatSize(size) // as in directory listings
+	}
+	return info, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// statEntry is a result of a bulk stat request.
+type statEntry struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	SizeText string `json:"sizeText"`
+	Error    string `json:"error"`
+	Status   int    `json:"status"`
+}
+
+// statPaths serves a bulk stat request for the paths.
+func statPaths(t *testing.T, h http.Handler, paths ...string) []statEntry {
+	t.Helper()
+	b, err := json.Marshal(map[string][]string{"paths": paths})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body := serveRequest(h, httptest.NewRequest(http.MethodPost, statPath, strings.NewReader(string(b))))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST %s: status = %d, body = %s", statPath, resp.StatusCode, body)
+	}
+	var results []statEntry
+	if err := json.Unmarshal([]byte(body), &results); err != nil {
+		t.Fatalf("POST %s: invalid JSON: %v", statPath, err)
+	}
+	return results
+}
+
+func TestStat(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt":         "hello",
+		"sub/b.txt":     "world",
+		"secret/c.txt":  "secret",
+		"private/d.txt": "private",
+		".hidden/e.txt": "hidden",
+		"dirlike/":      "",
+	})
+	setValue(t, deny, "^/secret/|^/private/d[.]txt$")
+	h := newTestHandler(t, root)
+
+	for _, tt := range []struct {
+		path     string
+		name     string
+		sizeText string
+		status   int
+	}{
+		{"/a.txt", "a.txt", "5B", 0},
+		{"/sub", "sub/", "", 0},
+		{"/sub/", "sub/", "", 0},
+		{"/sub/./b.txt", "b.txt", "5B", 0},
+		{"/", "./", "", 0},
+		{"/dirlike", "dirlike/", "", 0},
+		{"/missing", "", "", http.StatusNotFound},
+		{"/secret", "", "", http.StatusForbidden},
+		{"/secret/", "", "", http.StatusForbidden},
+		{"/secret/c.txt", "", "", http.StatusForbidden},
+		{"/private/", "private/", "", 0},
+		{"/private/d.txt", "", "", http.StatusForbidden},
+		{"/.hidden", "", "", http.StatusNotFound},
+		{"/.hidden/", "", "", http.StatusNotFound},
+		{"sub", "", "", http.StatusBadRequest},
+		{"/../a.txt", "a.txt", "5B", 0}, // cleaned to /a.txt
+	} {
+		res := statPaths(t, h, tt.path)[0]
+		switch {
+		case res.Status != tt.status:
+			t.Errorf("stat %q: status = %d (%s), want %d", tt.path, res.Status, res.Error, tt.status)
+		case res.Name != tt.name:
+			t.Errorf("stat %q: name = %q, want %q", tt.path, res.Name, tt.name)
+		case res.SizeText != tt.sizeText:
+			t.Errorf("stat %q: sizeText = %q, want %q", tt.path, res.SizeText, tt.sizeText)
+		}
+	}
+
+	// Direct requests agree with the stat results for denied directories.
+	for _, target := range []string{"/secret/", "/secret"} {
+		if resp, _ := get(h, target); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s: status = %d, want 403", target, resp.StatusCode)
+		}
+	}
+}
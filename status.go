@@ -0,0 +1,81 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// statusPath is the URL path that reports statistics about the server.
+const statusPath = "/.status"
+
+// stats are statistics about the requests served since startup.
+var stats struct {
+	start    time.Time
+	inFlight atomic.Int64
+	bytes    atomic.Int64
+	byStatus [600]atomic.Int64 // number of responses by status code
+}
+
+// recordStats records a served response in stats.
+func recordStats(rec *responseRecorder) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK // nothing was written
+	}
+	if status < len(stats.byStatus) {
+		stats.byStatus[status].Add(1)
+	}
+	stats.bytes.Add(rec.bytes)
+}
+
+// serveStatus serves the statistics about the server as JSON.
+// If logins are disabled, only clients on the same host may request it.
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	if authUsers == nil && !isLocalClient(r) {
+		httpError(w, r, fmt.Errorf("%w: status is only available to local clients", fs.ErrPermission))
+		return
+	}
+	requests := make(map[string]int64)
+	var total int64
+	for code := range stats.byStatus {
+		if n := stats.byStatus[code].Load(); n > 0 {
+			requests[strconv.Itoa(code)] = n
+			total += n
+		}
+	}
+	b, err := json.Marshal(struct {
+		Start         time.Time        `json:"start"`
+		UptimeSeconds int64            `json:"uptimeSeconds"`
+		InFlight      int64            `json:"inFlight"` // includes this request
+		Requests      int64            `json:"requests"`
+		ByStatus      map[string]int64 `json:"byStatus"`
+		Bytes         int64            `json:"bytes"`
+	}{stats.start, int64(time.Since(stats.start).Seconds()), stats.inFlight.Load(), total, requests, stats.bytes.Load()})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// isLocalClient reports whether the client is on the same host,
+// and not forwarded by a proxy on the same host.
+func isLocalClient(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() && r.Header.Get("X-Forwarded-For") == "" && r.Header.Get("Forwarded") == ""
+}
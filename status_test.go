@@ -0,0 +1,86 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// statusResult is the statistics reported by the status endpoint.
+type statusResult struct {
+	InFlight int64            `json:"inFlight"`
+	Requests int64            `json:"requests"`
+	ByStatus map[string]int64 `json:"byStatus"`
+	Bytes    int64            `json:"bytes"`
+}
+
+// getStatus serves a status request from a local client.
+func getStatus(t *testing.T, h http.Handler) (statusResult, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, statusPath, nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	resp, body := serveRequest(h, r)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d, want %d", statusPath, resp.StatusCode, http.StatusOK)
+	}
+	var got statusResult
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatalf("GET %s: %v", statusPath, err)
+	}
+	return got, body
+}
+
+func TestStatus(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt": "hello",
+		"b.txt": "goodbye",
+	})
+	h := newTestHandler(t, root)
+
+	before, beforeBody := getStatus(t, h)
+	if before.InFlight != 1 {
+		t.Errorf("inFlight = %d, want 1 (the status request)", before.InFlight)
+	}
+
+	var bytes int64
+	for _, target := range []string{"/a.txt", "/b.txt", "/missing.txt", "/a.txt"} {
+		_, body := get(h, target)
+		bytes += int64(len(body))
+	}
+
+	// The first status request is counted once it has been served.
+	after, _ := getStatus(t, h)
+	if after.InFlight != 1 {
+		t.Errorf("inFlight = %d, want 1 (the status request)", after.InFlight)
+	}
+	if got, want := after.Requests-before.Requests, int64(5); got != want {
+		t.Errorf("requests increased by %d, want %d", got, want)
+	}
+	if got, want := after.ByStatus["200"]-before.ByStatus["200"], int64(4); got != want {
+		t.Errorf("byStatus[200] increased by %d, want %d", got, want)
+	}
+	if got, want := after.ByStatus["404"]-before.ByStatus["404"], int64(1); got != want {
+		t.Errorf("byStatus[404] increased by %d, want %d", got, want)
+	}
+	if got, want := after.Bytes-before.Bytes, bytes+int64(len(beforeBody)); got != want {
+		t.Errorf("bytes increased by %d, want %d", got, want)
+	}
+
+	// Clients on other hosts or behind a proxy are denied
+	// unless logins are enabled.
+	if resp, _ := get(h, statusPath); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET %s from a remote client: status %d, want %d", statusPath, resp.StatusCode, http.StatusForbidden)
+	}
+	r := httptest.NewRequest(http.MethodGet, statusPath, nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	if resp, _ := serveRequest(h, r); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET %s through a proxy: status %d, want %d", statusPath, resp.StatusCode, http.StatusForbidden)
+	}
+}
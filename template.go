@@ -0,0 +1,146 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultTemplates are the built-in templates used to render HTML pages.
+//
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+// templateNames are the names of all templates.
+// Each template may be overridden by a file of the same name
+// in the directory specified by -template-dir.
+var templateNames = []string{
+	"main.html",   // executed with a htmlPage
+	"body.html",   // executed with a listingPage
+	"recent.html", // executed with a recentPage
+	"share.html",  // executed with a sharePage
+	"login.html",  // executed with a loginPage
+	"error.html",  // executed with an errorPage
+}
+
+// htmlPage is the data for the main.html template,
+// which renders the page surrounding the body of every HTML response.
+type htmlPage struct {
+	Title       string
+	Breadcrumbs []breadcrumb // links to the path and each of its parents
+	Body        template.HTML
+	User        string // the logged in user, if any
+	LogoutURL   string
+}
+
+// breadcrumb is a link to one element of the path of a request.
+type breadcrumb struct {
+	Name string
+	URL  string
+}
+
+// listingPage is the data for the body.html template,
+// which renders the body of a directory listing.
+type listingPage struct {
+	Entries    []fileInfo
+	Filter     string // the filter pattern if the entries are filtered
+	Shown      int    // the number of entries shown, excluding any parent entry
+	Matched    int    // the number of entries matching the filter
+	Total      int    // the number of entries in the directory
+	Next       string // the URL of the next page of entries if truncated
+	Sidecars   bool   // whether the entries have sidecar metadata
+	Owners     bool   // whether the entries have owners (if known)
+	LinkCounts bool   // whether the entries have hard link counts (if known)
+	Readme     string
+	Now        time.Time
+}
+
+// recentPage is the data for the recent.html template,
+// which renders the body of the '?recent=N' view of a directory.
+type recentPage struct {
+	Files     []recentFile
+	Truncated bool // whether the directory tree was too large to fully search
+	Now       time.Time
+}
+
+// sharePage is the data for the share.html template,
+// which renders the password form of a password-protected share link.
+type sharePage struct {
+	Name      string // the base name of the shared file
+	Incorrect bool   // whether an incorrect password was submitted
+}
+
+// loginPage is the data for the login.html template,
+// which renders the login form.
+type loginPage struct {
+	Username  string // the previously submitted username
+	Incorrect bool   // whether an incorrect username, password, or code was submitted
+	TOTP      bool   // whether a two-factor authentication code is required
+}
+
+// errorPage is the data for the error.html template,
+// which renders the body of an error response.
+type errorPage struct {
+	Status     int
+	StatusText string
+	Message    string
+}
+
+// templateFuncs are the functions available to all templates.
+var templateFuncs = template.FuncMap{
+	// urlPath formats a relative path as a URL.
+	"urlPath": func(p string) string { return (&url.URL{Path: p}).String() },
+	// formatSize formats a size in bytes according to -size-units.
+	"formatSize": formatSize,
+	// formatTime formats a time relative to now.
+	"formatTime": formatTime,
+}
+
+// parseTemplates parses all the templates, using the files in dir
+// to override any of the built-in templates. If dir is empty,
+// then only the built-in templates are used.
+func parseTemplates(dir string) (*template.Template, error) {
+	t := template.New("").Funcs(templateFuncs)
+	for _, name := range templateNames {
+		b, err := fs.ReadFile(defaultTemplates, "templates/"+name)
+		if err != nil {
+			return nil, err
+		}
+		if dir != "" {
+			if b2, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+				b = b2
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+		if _, err := t.New(name).Parse(string(b)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// renderTemplate renders the named template as the body of an HTML page.
+// The status code and dirTitle are passed to renderHTML.
+func renderTemplate(w http.ResponseWriter, r *http.Request, code int, dirTitle, name string, data any) {
+	var bb bytes.Buffer
+	if err := pageTemplates.ExecuteTemplate(&bb, name, data); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	renderHTML(w, r, code, dirTitle, func(w io.Writer) {
+		w.Write(bb.Bytes())
+	})
+}
@@ -0,0 +1,162 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// errFSTimeout reports that a file system operation did not complete
+// within the -fs-timeout duration.
+var errFSTimeout = errors.New("file system operation timed out")
+
+// timeoutFS is a file system where every operation fails with errFSTimeout
+// if it does not complete within the timeout (e.g., on a hung network mount).
+//
+// The blocking call is made in a separate goroutine, which is abandoned
+// upon a timeout. Since the underlying call cannot be interrupted,
+// the goroutine leaks until that call eventually returns (if ever).
+type timeoutFS struct {
+	fs.FS
+	timeout time.Duration
+}
+
+// withTimeout calls fn in a separate goroutine and waits up to d
+// for it to return. Upon a timeout, cleanup (if non-nil) is called
+// with the result of fn once it eventually returns.
+func withTimeout[T any](d time.Duration, fn func() (T, error), cleanup func(T)) (T, error) {
+	type result struct {
+		v   T
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		v, err := fn()
+		c <- result{v, err}
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case res := <-c:
+		return res.v, res.err
+	case <-t.C:
+		if cleanup != nil {
+			go func() {
+				if res := <-c; res.err == nil {
+					cleanup(res.v)
+				}
+			}()
+		}
+		var zero T
+		return zero, errFSTimeout
+	}
+}
+
+func (fsys timeoutFS) Open(name string) (fs.File, error) {
+	f, err := withTimeout(fsys.timeout, func() (fs.File, error) {
+		return fsys.FS.Open(name)
+	}, func(f fs.File) { f.Close() })
+	if err != nil {
+		if err == errFSTimeout {
+			err = &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return nil, err
+	}
+	return &timeoutFile{f: f, name: name, timeout: fsys.timeout}, nil
+}
+
+func (fsys timeoutFS) ReadLink(name string) (string, error) {
+	rfs, ok := fsys.FS.(readLinkFS)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+	}
+	target, err := withTimeout(fsys.timeout, func() (string, error) {
+		return rfs.ReadLink(name)
+	}, nil)
+	if err == errFSTimeout {
+		err = &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, err
+}
+
+// timeoutFile is a file opened from a timeoutFS.
+type timeoutFile struct {
+	f       fs.File
+	name    string
+	timeout time.Duration
+}
+
+func (f *timeoutFile) Stat() (fs.FileInfo, error) {
+	fi, err := withTimeout(f.timeout, f.f.Stat, nil)
+	return fi, f.wrapError("stat", err)
+}
+
+func (f *timeoutFile) Read(b []byte) (int, error) {
+	// Read into a separate buffer since an abandoned read
+	// must not write to b after returning.
+	buf, err := withTimeout(f.timeout, func() ([]byte, error) {
+		buf := make([]byte, len(b))
+		n, err := f.f.Read(buf)
+		return buf[:n], err
+	}, nil)
+	return copy(b, buf), f.wrapError("read", err)
+}
+
+func (f *timeoutFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.f.(io.Seeker)
+	if !ok {
+		return 0, f.wrapError("seek", errors.ErrUnsupported)
+	}
+	n, err := withTimeout(f.timeout, func() (int64, error) {
+		return s.Seek(offset, whence)
+	}, nil)
+	return n, f.wrapError("seek", err)
+}
+
+func (f *timeoutFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := f.f.(fs.ReadDirFile)
+	if !ok {
+		return nil, f.wrapError("readdir", errors.ErrUnsupported)
+	}
+	des, err := withTimeout(f.timeout, func() ([]fs.DirEntry, error) {
+		return d.ReadDir(n)
+	}, nil)
+	for i, de := range des {
+		des[i] = timeoutDirEntry{de, f.timeout}
+	}
+	return des, f.wrapError("readdir", err)
+}
+
+func (f *timeoutFile) Close() error {
+	_, err := withTimeout(f.timeout, func() (struct{}, error) {
+		return struct{}{}, f.f.Close()
+	}, nil)
+	return f.wrapError("close", err)
+}
+
+func (f *timeoutFile) wrapError(op string, err error) error {
+	if err == errFSTimeout {
+		return &fs.PathError{Op: op, Path: f.name, Err: err}
+	}
+	return err
+}
+
+// timeoutDirEntry is a directory entry read from a timeoutFile,
+// whose information may be lazily read from the file system.
+type timeoutDirEntry struct {
+	fs.DirEntry
+	timeout time.Duration
+}
+
+func (de timeoutDirEntry) Info() (fs.FileInfo, error) {
+	fi, err := withTimeout(de.timeout, de.DirEntry.Info, nil)
+	if err == errFSTimeout {
+		err = &fs.PathError{Op: "stat", Path: de.Name(), Err: err}
+	}
+	return fi, err
+}
@@ -0,0 +1,46 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serverTimer records the duration of each phase of serving a request,
+// which is reported in the Server-Timing header of the response.
+type serverTimer struct {
+	last   time.Time // end of the previous phase
+	phases []string  // each formatted as a Server-Timing metric
+}
+
+// mark ends the current phase with the given name.
+func (t *serverTimer) mark(name string) {
+	now := time.Now()
+	d := now.Sub(t.last)
+	t.last = now
+	t.phases = append(t.phases, fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond)))
+}
+
+// markTiming ends the current phase of serving the request with the given
+// name, if the response reports a Server-Timing header.
+func markTiming(w http.ResponseWriter, name string) {
+	if rec, ok := w.(*responseRecorder); ok && rec.timer != nil {
+		rec.timer.mark(name)
+	}
+}
+
+// setTimingHeader sets the Server-Timing header, where the final phase
+// is the time spent serving the response until the header is written.
+// Any time spent writing the response body is not reported.
+func (rec *responseRecorder) setTimingHeader() {
+	if rec.timer == nil {
+		return
+	}
+	rec.timer.mark("serve")
+	rec.Header().Set("Server-Timing", strings.Join(rec.timer.phases, ", "))
+}
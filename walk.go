@@ -0,0 +1,441 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errSymlinkLoop is reported to the walk function for a directory
+// that is the same as one of its ancestors.
+var errSymlinkLoop = errors.New("symbolic link loop")
+
+// walkDir is identical to fs.WalkDir, but optionally traverses
+// symbolic links to directories if followLinks is specified.
+//
+// When following links, a directory that is the same as one of its ancestors
+// (as determined by os.SameFile) is not traversed. Instead, fn is called
+// a second time for that directory with an error wrapping errSymlinkLoop.
+func walkDir(fsys fs.FS, root string, followLinks bool, fn fs.WalkDirFunc) error {
+	if !followLinks {
+		return fs.WalkDir(fsys, root, fn)
+	}
+	fi, err := fs.Stat(fsys, root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDirFollow(fsys, root, fs.FileInfoToDirEntry(fi), nil, fn)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkDirFollow(fsys fs.FS, name string, d fs.DirEntry, ancestors []fs.FileInfo, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	// Check whether this directory was already visited by an ancestor.
+	if fi, err := d.Info(); err == nil {
+		for _, fi2 := range ancestors {
+			if os.SameFile(fi, fi2) {
+				err := fn(name, d, &fs.PathError{Op: "walk", Path: name, Err: errSymlinkLoop})
+				if err == fs.SkipDir {
+					err = nil
+				}
+				return err
+			}
+		}
+		ancestors = append(ancestors, fi)
+	}
+
+	des, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		err = fn(name, d, err)
+		if err != nil {
+			if err == fs.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, de := range des {
+		name2 := path.Join(name, de.Name())
+		if de.Type()&fs.ModeSymlink != 0 {
+			if fi, err := fs.Stat(fsys, name2); err == nil && fi.IsDir() {
+				de = fs.FileInfoToDirEntry(fi)
+			}
+		}
+		if err := walkDirFollow(fsys, name2, de, ancestors, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// walkVisible walks the directory tree of the request, calling fn for
+// every regular file that is neither hidden nor denied.
+// Symbolic links are not followed. The walk stops with ctx.Err()
+// if the context is done (e.g., the walk-timeout deadline is exceeded).
+// If maxDepth is positive, directories more than maxDepth levels
+// below the requested directory are not walked.
+func walkVisible(ctx context.Context, r *http.Request, cfg *config, dir fs.FS, maxDepth int, fn func(name string, fi fs.FileInfo) error) error {
+	root := strings.Trim(r.URL.Path, "/")
+	if root == "" {
+		root = "."
+	}
+	return walkDir(dir, root, false, func(name string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return nil // ignore unreadable files and directories
+		}
+		if name != root {
+			urlPath := "/" + name
+			if d.IsDir() {
+				urlPath += "/"
+			}
+			if regexpMatch(cfg.hideRx, urlPath) || regexpMatch(cfg.denyRx, urlPath) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() && maxDepth > 0 && strings.Count(strings.TrimPrefix(name, root+"/"), "/") >= maxDepth {
+				return fs.SkipDir
+			}
+			if d.IsDir() && listingDisabled(dir, urlPath) {
+				return fs.SkipDir
+			}
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		return fn(name, fi)
+	})
+}
+
+// recentFile is a file in the directory tree
+// with a path relative to the requested directory.
+type recentFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// recentHeap is a min-heap of files ordered by modification time.
+type recentHeap []recentFile
+
+func (h recentHeap) Len() int            { return len(h) }
+func (h recentHeap) Less(i, j int) bool  { return h[i].ModTime.Before(h[j].ModTime) }
+func (h recentHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recentHeap) Push(x interface{}) { *h = append(*h, x.(recentFile)) }
+func (h *recentHeap) Pop() interface{} {
+	x := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return x
+}
+
+// serveRecent serves the N most recently modified files
+// in the directory tree of the request, newest first.
+func serveRecent(w http.ResponseWriter, r *http.Request, cfg *config, dir fs.FS) {
+	const maxRecent = 1000
+	n, err := strconv.Atoi(r.URL.Query().Get("recent"))
+	if err != nil || n <= 0 || n > maxRecent {
+		httpError(w, r, badRequestError("recent must be an integer between 1 and "+strconv.Itoa(maxRecent)))
+		return
+	}
+
+	// Collect the most recent files using a bounded heap.
+	ctx, cancel := context.WithTimeout(r.Context(), *walkTimeout)
+	defer cancel()
+	root := strings.Trim(r.URL.Path, "/")
+	var h recentHeap
+	err = walkVisible(ctx, r, cfg, dir, 0, func(name string, fi fs.FileInfo) error {
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+		heap.Push(&h, recentFile{Path: rel, Size: fi.Size(), ModTime: fi.ModTime()})
+		if h.Len() > n {
+			heap.Pop(&h)
+		}
+		return nil
+	})
+	truncated := errors.Is(err, context.DeadlineExceeded)
+	if err != nil && !truncated {
+		httpError(w, r, err)
+		return
+	}
+	files := []recentFile(h)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.After(files[j].ModTime)
+	})
+
+	if negotiateType(r, "text/html", "application/json") == "application/json" {
+		b, err := json.Marshal(struct {
+			Files     []recentFile `json:"files"`
+			Truncated bool         `json:"truncated"`
+		}{append([]recentFile{}, files...), truncated})
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(b, '\n'))
+		return
+	}
+	renderTemplate(w, r, http.StatusOK, "", "recent.html", recentPage{files, truncated, time.Now()})
+}
+
+// serveDupes serves groups of identical files in the directory tree
+// of the request as JSON. Files are grouped by size first, and only files
+// that share a size with another file are hashed to confirm they are equal.
+// Files are hashed during the walk so that the groups found so far
+// can be reported if the walk times out.
+func serveDupes(w http.ResponseWriter, r *http.Request, cfg *config, dir fs.FS) {
+	ctx, cancel := context.WithTimeout(r.Context(), *walkTimeout)
+	defer cancel()
+
+	// Group all files by size, then by hash once a size is shared.
+	type sizeGroup struct {
+		first  string // hashed once another file has the same size
+		byHash map[[sha256.Size]byte][]string
+	}
+	root := strings.Trim(r.URL.Path, "/")
+	bySize := make(map[int64]*sizeGroup)
+	addHash := func(g *sizeGroup, name string) error {
+		sum, err := hashFile(ctx, dir, name)
+		if err != nil {
+			return ctx.Err() // ignore unreadable files, unless the walk is done
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+		g.byHash[sum] = append(g.byHash[sum], rel)
+		return nil
+	}
+	err := walkVisible(ctx, r, cfg, dir, 0, func(name string, fi fs.FileInfo) error {
+		if fi.Size() < *dupesMinSize {
+			return nil
+		}
+		g := bySize[fi.Size()]
+		if g == nil {
+			bySize[fi.Size()] = &sizeGroup{first: name}
+			return nil
+		}
+		if g.byHash == nil {
+			g.byHash = make(map[[sha256.Size]byte][]string)
+			if err := addHash(g, g.first); err != nil {
+				return err
+			}
+		}
+		return addHash(g, name)
+	})
+
+	// Report every group of files with the same hash.
+	type dupeGroup struct {
+		Size  int64    `json:"size"`
+		Paths []string `json:"paths"`
+	}
+	groups := []dupeGroup{}
+	for size, g := range bySize {
+		for _, rels := range g.byHash {
+			if len(rels) >= 2 {
+				sort.Strings(rels)
+				groups = append(groups, dupeGroup{Size: size, Paths: rels})
+			}
+		}
+	}
+	truncated := errors.Is(err, context.DeadlineExceeded)
+	if err != nil && !truncated {
+		httpError(w, r, err)
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Size != groups[j].Size {
+			return groups[i].Size > groups[j].Size
+		}
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+
+	b, err := json.Marshal(struct {
+		Groups    []dupeGroup `json:"groups"`
+		Truncated bool        `json:"truncated"`
+	}{groups, truncated})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// maxDiskUsageCache is the maximum number of results in the disk usage cache.
+const maxDiskUsageCache = 1000
+
+// diskUsageCache caches the results of the ?du view, keyed by the
+// directory path and depth. A result is valid until the -du-cache-ttl
+// duration elapses, the modification time of the directory changes,
+// or the config is reloaded. Changes deeper in the tree do not modify
+// the directory, so they go unnoticed until then. When the cache is full,
+// the oldest result is evicted.
+var diskUsageCache struct {
+	sync.Mutex
+	entries map[string]diskUsageResult
+	order   []string // keys in the order they were added
+}
+
+type diskUsageResult struct {
+	cfg     *config
+	modTime time.Time
+	expires time.Time
+	body    []byte
+}
+
+// serveDiskUsage serves the total size of regular files in the directory
+// tree of the request as JSON, along with the size of each immediate child,
+// similar to "du -s *". The "depth" query parameter optionally limits
+// how many levels of subdirectories are walked, and the "refresh"
+// query parameter forces the result to be recomputed instead of cached.
+func serveDiskUsage(w http.ResponseWriter, r *http.Request, cfg *config, dir fs.FS, fi fs.FileInfo) {
+	var depth int
+	if s := r.URL.Query().Get("depth"); s != "" {
+		var err error
+		if depth, err = strconv.Atoi(s); err != nil || depth <= 0 {
+			httpError(w, r, badRequestError("depth must be a positive integer"))
+			return
+		}
+	}
+	key := r.URL.Path + "\x00" + strconv.Itoa(depth)
+	if *duCacheTTL > 0 && !r.URL.Query().Has("refresh") {
+		diskUsageCache.Lock()
+		res, ok := diskUsageCache.entries[key]
+		diskUsageCache.Unlock()
+		if ok && res.cfg == cfg && res.modTime.Equal(fi.ModTime()) && time.Now().Before(res.expires) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(res.body)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), *walkTimeout)
+	defer cancel()
+
+	// Sum the file sizes by the immediate child they are within.
+	root := strings.Trim(r.URL.Path, "/")
+	var total int64
+	sizes := make(map[string]int64)
+	err := walkVisible(ctx, r, cfg, dir, depth, func(name string, fi fs.FileInfo) error {
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+		child, _, isDir := strings.Cut(rel, "/")
+		if isDir {
+			child += "/"
+		}
+		sizes[child] += fi.Size()
+		total += fi.Size()
+		return nil
+	})
+	truncated := errors.Is(err, context.DeadlineExceeded)
+	if err != nil && !truncated {
+		httpError(w, r, err)
+		return
+	}
+
+	type duEntry struct {
+		Name string `json:"name"` // has a trailing slash for directories
+		Size int64  `json:"size"`
+	}
+	entries := []duEntry{}
+	for name, size := range sizes {
+		entries = append(entries, duEntry{name, size})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	b, err := json.Marshal(struct {
+		Size      int64     `json:"size"`
+		Entries   []duEntry `json:"entries"`
+		Truncated bool      `json:"truncated"`
+	}{total, entries, truncated})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	b = append(b, '\n')
+	if *duCacheTTL > 0 && !truncated {
+		storeDiskUsage(key, diskUsageResult{cfg, fi.ModTime(), time.Now().Add(*duCacheTTL), b})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// storeDiskUsage adds a result to the disk usage cache.
+func storeDiskUsage(key string, res diskUsageResult) {
+	c := &diskUsageCache
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]diskUsageResult)
+	}
+	if _, ok := c.entries[key]; !ok {
+		for len(c.order) >= maxDiskUsageCache {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = res
+}
+
+// hashFile computes the SHA-256 hash of the named file,
+// stopping early with ctx.Err() if the context is done.
+func hashFile(ctx context.Context, dir fs.FS, name string) (sum [sha256.Size]byte, err error) {
+	f, err := dir.Open(name)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, ctxReader{ctx, f}); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// ctxReader is an io.Reader that fails once the context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(b)
+}
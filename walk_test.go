@@ -0,0 +1,217 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWalkDirSymlinkLoop(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a/file": "", "b/": ""})
+	for name, target := range map[string]string{
+		"a/loop": "..",   // loops back to the root
+		"b/a":    "../a", // a directory visited twice, but not a loop
+	} {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Skipf("symbolic links unsupported: %v", err)
+		}
+	}
+	dir, err := openRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		visited, loops []string
+		err            error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		res.err = walkDir(dir, ".", true, func(name string, d fs.DirEntry, err error) error {
+			switch {
+			case errors.Is(err, errSymlinkLoop):
+				res.loops = append(res.loops, name)
+			case err != nil:
+				return err
+			default:
+				res.visited = append(res.visited, name)
+			}
+			return nil
+		})
+		done <- res
+	}()
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("walkDir did not terminate")
+	}
+	if res.err != nil {
+		t.Fatalf("walkDir error: %v", res.err)
+	}
+
+	sort.Strings(res.visited)
+	sort.Strings(res.loops)
+	wantVisited := []string{".", "a", "a/file", "a/loop", "b", "b/a", "b/a/file", "b/a/loop"}
+	wantLoops := []string{"a/loop", "b/a/loop"}
+	if !reflect.DeepEqual(res.visited, wantVisited) {
+		t.Errorf("visited %q, want %q", res.visited, wantVisited)
+	}
+	if !reflect.DeepEqual(res.loops, wantLoops) {
+		t.Errorf("loops reported for %q, want %q", res.loops, wantLoops)
+	}
+}
+
+// slowFS is a file system where opening the named file is slow.
+type slowFS struct {
+	fs.FS
+	name  string
+	delay time.Duration
+}
+
+func (fsys slowFS) Open(name string) (fs.File, error) {
+	if name == fsys.name {
+		time.Sleep(fsys.delay)
+	}
+	return fsys.FS.Open(name)
+}
+
+func TestDupes(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a1":     "same",
+		"a2":     "same",
+		"b":      "diff",
+		"c/a3":   "same",
+		"d":      "other size",
+		"empty1": "",
+		"empty2": "",
+		"zz/x":   "x",
+	})
+	dir, err := openRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFlagsConfig(t, dir)
+	type dupes struct {
+		Groups []struct {
+			Size  int64    `json:"size"`
+			Paths []string `json:"paths"`
+		} `json:"groups"`
+		Truncated bool `json:"truncated"`
+	}
+	getDupes := func(h http.Handler) (v dupes) {
+		t.Helper()
+		resp, body := get(h, "/?dupes=true")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /?dupes=true: status = %d", resp.StatusCode)
+		}
+		if err := json.Unmarshal([]byte(body), &v); err != nil {
+			t.Fatalf("GET /?dupes=true: invalid JSON: %v", err)
+		}
+		return v
+	}
+
+	got := getDupes(newHandler(dir))
+	if len(got.Groups) != 1 || got.Groups[0].Size != 4 || !reflect.DeepEqual(got.Groups[0].Paths, []string{"a1", "a2", "c/a3"}) || got.Truncated {
+		t.Errorf("dupes = %+v, want one group of a1, a2, and c/a3", got)
+	}
+
+	// Groups found before the walk times out are still reported.
+	// The timeout occurs while walking the last directory.
+	setValue(t, walkTimeout, 50*time.Millisecond)
+	got = getDupes(newHandler(slowFS{dir, "zz", 200 * time.Millisecond}))
+	if len(got.Groups) != 1 || !reflect.DeepEqual(got.Groups[0].Paths, []string{"a1", "a2", "c/a3"}) || !got.Truncated {
+		t.Errorf("dupes after a timeout = %+v, want one group of a1, a2, and c/a3 that is truncated", got)
+	}
+}
+
+func TestNoIndex(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.txt":                "hello",
+		"open/b.txt":           "open",
+		"closed/.noindex":      "",
+		"closed/c.txt":         "closed",
+		"closed/nested/d.txt":  "nested",
+		"withindex/.noindex":   "",
+		"withindex/index.html": "<p>index</p>",
+	})
+	setValue(t, index, "/index[.]html$")
+	h := newTestHandler(t, root)
+
+	for target, want := range map[string]int{
+		"/":                    http.StatusOK,
+		"/open/":               http.StatusOK,
+		"/closed/":             http.StatusForbidden,
+		"/closed/nested/":      http.StatusOK, // only the directory itself is unlisted
+		"/closed/c.txt":        http.StatusOK,
+		"/closed/nested/d.txt": http.StatusOK,
+		"/closed/?recent=10":   http.StatusForbidden,
+		"/closed/?du=true":     http.StatusForbidden,
+		"/closed/?dupes=true":  http.StatusForbidden,
+		"/withindex/":          http.StatusOK,
+		"/closed/.noindex":     http.StatusOK,
+	} {
+		if resp, _ := get(h, target); resp.StatusCode != want {
+			t.Errorf("GET %s: status = %d, want %d", target, resp.StatusCode, want)
+		}
+	}
+	if _, body := get(h, "/withindex/"); !strings.Contains(body, "<p>index</p>") {
+		t.Errorf("GET /withindex/ did not serve the index file")
+	}
+
+	// The directory tree views of ancestors skip unlisted directories.
+	r := httptest.NewRequest(http.MethodGet, "/?recent=10", nil)
+	r.Header.Set("Accept", "application/json")
+	_, body := serveRequest(h, r)
+	var recent struct {
+		Files []struct {
+			Path string `json:"path"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal([]byte(body), &recent); err != nil {
+		t.Fatalf("GET /?recent=10: invalid JSON: %v", err)
+	}
+	var paths []string
+	for _, f := range recent.Files {
+		paths = append(paths, f.Path)
+	}
+	sort.Strings(paths)
+	if want := []string{"a.txt", "open/b.txt"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("GET /?recent=10: paths = %q, want %q", paths, want)
+	}
+
+	_, body = get(h, "/?du=true")
+	var du struct {
+		Size    int64 `json:"size"`
+		Entries []struct {
+			Name string `json:"name"`
+		} `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(body), &du); err != nil {
+		t.Fatalf("GET /?du=true: invalid JSON: %v", err)
+	}
+	var names []string
+	for _, e := range du.Entries {
+		names = append(names, e.Name)
+	}
+	if want := []string{"a.txt", "open/"}; !reflect.DeepEqual(names, want) || du.Size != int64(len("hello")+len("open")) {
+		t.Errorf("GET /?du=true: entries = %q with size %d, want %q with size %d", names, du.Size, want, len("hello")+len("open"))
+	}
+}
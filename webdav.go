@@ -0,0 +1,129 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// methodPropfind is the WebDAV method for retrieving properties.
+// See RFC 4918, section 9.1.
+const methodPropfind = "PROPFIND"
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href   string  `xml:"D:href"`
+	Prop   davProp `xml:"D:propstat>D:prop"`
+	Status string  `xml:"D:propstat>D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// servePropfind serves a minimal read-only PROPFIND request,
+// sufficient for WebDAV clients to browse the file tree.
+// The request body is ignored and all supported properties are reported.
+// A Depth of "0" only describes the requested resource, while a Depth of "1"
+// (or none) also describes the children of a directory. A Depth of "infinity"
+// is rejected, as permitted by RFC 4918, section 9.1.
+func servePropfind(w http.ResponseWriter, r *http.Request, cfg *config, dir fs.FS, fi fs.FileInfo) {
+	io.Copy(io.Discard, io.LimitReader(r.Body, 1<<20))
+
+	depth := r.Header.Get("Depth")
+	switch depth {
+	case "0", "1", "":
+	case "infinity":
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, xml.Header+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`+"\n")
+		return
+	default:
+		httpError(w, r, badRequestError("invalid depth"))
+		return
+	}
+
+	ms := davMultistatus{XMLNS: "DAV:"}
+	ms.Responses = append(ms.Responses, newDAVResponse(r, r.URL.Path, fi))
+	if fi.IsDir() && depth != "0" {
+		if listingDisabled(dir, r.URL.Path) {
+			httpError(w, r, errListingDisabled)
+			return
+		}
+		fes, err := fs.ReadDir(dir, filepath.Join(".", filepath.FromSlash(r.URL.Path)))
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		sort.Slice(fes, func(i, j int) bool {
+			return fes[i].Name() < fes[j].Name()
+		})
+		for _, fe := range fes {
+			if fe.Name() == titleFile || fe.Name() == noIndexFile {
+				continue // never listed
+			}
+			fi, _ := fs.Stat(dir, filepath.Join(".", filepath.FromSlash(r.URL.Path), fe.Name()))
+			if fi == nil {
+				continue
+			}
+			urlPath := path.Join(r.URL.Path, fe.Name())
+			if fi.IsDir() {
+				urlPath += "/"
+			}
+			if regexpMatch(cfg.hideRx, urlPath) || regexpMatch(cfg.denyRx, urlPath) || isRedirectsFile(urlPath) {
+				continue
+			}
+			ms.Responses = append(ms.Responses, newDAVResponse(r, urlPath, fi))
+		}
+	}
+
+	b, err := xml.MarshalIndent(ms, "", "\t")
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
+
+func newDAVResponse(r *http.Request, urlPath string, fi fs.FileInfo) davResponse {
+	resp := davResponse{
+		Href:   (&url.URL{Path: externalPrefix(r) + urlPath}).EscapedPath(),
+		Status: "HTTP/1.1 200 OK",
+	}
+	resp.Prop.DisplayName = fi.Name()
+	if urlPath == "/" {
+		resp.Prop.DisplayName = ""
+	}
+	if fi.IsDir() {
+		resp.Prop.ResourceType.Collection = new(struct{})
+	} else if fi.Mode().IsRegular() {
+		size := fi.Size()
+		resp.Prop.ContentLength = &size
+	}
+	resp.Prop.LastModified = fi.ModTime().UTC().Format(http.TimeFormat)
+	return resp
+}
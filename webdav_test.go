@@ -0,0 +1,90 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPropfind(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":            "hello",
+		"b c.txt":          "spaces",
+		".hidden":          "",
+		".title":           "Title",
+		"secret.txt":       "",
+		"sub/":             "",
+		"sub/d.txt":        "",
+		"closed/":          "",
+		"closed/.noindex":  "",
+		"closed/inner.txt": "",
+	}
+	writeFiles(t, root, files)
+	modTime := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	for name := range files {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(root, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	setValue(t, hide, "^/[.]hidden$") // not other dot files
+	setValue(t, deny, "^/secret[.]txt$")
+	h := newTestHandler(t, root)
+
+	propfind := func(target, depth string) (*http.Response, string) {
+		r := httptest.NewRequest(methodPropfind, target, nil)
+		if depth != "" {
+			r.Header.Set("Depth", depth)
+		}
+		return serveRequest(h, r)
+	}
+
+	// Hidden, denied, and control files are never reported.
+	for _, tt := range []struct {
+		target string
+		depth  string
+		golden string
+	}{
+		{"/", "0", "propfind_depth0.golden"},
+		{"/", "1", "propfind_depth1.golden"},
+		{"/", "", "propfind_depth1.golden"},
+		{"/a.txt", "1", "propfind_file.golden"},
+	} {
+		resp, body := propfind(tt.target, tt.depth)
+		if resp.StatusCode != http.StatusMultiStatus || resp.Header.Get("Content-Type") != "application/xml; charset=utf-8" {
+			t.Errorf("PROPFIND %s with Depth %q = (%d, %s), want (207, application/xml)", tt.target, tt.depth, resp.StatusCode, resp.Header.Get("Content-Type"))
+			continue
+		}
+		checkGolden(t, tt.golden, []byte(body))
+	}
+
+	// Directories with a .noindex file can only be described themselves.
+	if resp, _ := propfind("/closed/", "0"); resp.StatusCode != http.StatusMultiStatus {
+		t.Errorf("PROPFIND /closed/ with Depth 0: status = %d, want 207", resp.StatusCode)
+	}
+	if resp, body := propfind("/closed/", "1"); resp.StatusCode != http.StatusForbidden || strings.Contains(body, "inner.txt") {
+		t.Errorf("PROPFIND /closed/ with Depth 1 = (%d, %q), want 403 without the entries", resp.StatusCode, body)
+	}
+
+	// Denied paths are rejected, and an infinite depth is not supported.
+	if resp, _ := propfind("/secret.txt", "0"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("PROPFIND /secret.txt: status = %d, want 403", resp.StatusCode)
+	}
+	if resp, body := propfind("/", "infinity"); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "<D:propfind-finite-depth/>") {
+		t.Errorf("PROPFIND / with Depth infinity = (%d, %q), want 403 with propfind-finite-depth", resp.StatusCode, body)
+	}
+	if resp, _ := propfind("/", "2"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PROPFIND / with Depth 2: status = %d, want 400", resp.StatusCode)
+	}
+}